@@ -471,9 +471,26 @@ func (c *Client) AddCertToServer(pwd string) error {
 	return ParseError(raw)
 }
 
-func (c *Client) Create(name string) (*Response, error) {
+// Create creates a container from an image on an image server. insecure is
+// whether the user marked the image server as insecure, which plain http
+// image servers need to be.
+func (c *Client) Create(name string, imageURL string, imageName string, insecure bool) (*Response, error) {
+	source := Jmap{"type": "remote", "url": imageURL, "name": imageName, "insecure": insecure}
+	return c.createContainer(name, source)
+}
+
+func (c *Client) CreateFromImage(name string, image string) (*Response, error) {
+	source := Jmap{"type": "image", "fingerprint": image}
+	return c.createContainer(name, source)
+}
 
-	source := Jmap{"type": "remote", "url": "https+lxc-images://images.linuxcontainers.org", "name": "lxc-images/ubuntu/trusty/amd64"}
+// Copy creates a container from another container on the same daemon, or
+// from one of its snapshots when source is "<container>/<snapshot>".
+func (c *Client) Copy(source string, name string) (*Response, error) {
+	return c.createContainer(name, Jmap{"type": "copy", "source": source})
+}
+
+func (c *Client) createContainer(name string, source Jmap) (*Response, error) {
 	body := Jmap{"source": source}
 
 	if name != "" {
@@ -522,8 +539,28 @@ func (c *Client) Action(name string, action ContainerAction, timeout int, force
 	return resp, nil
 }
 
-func (c *Client) Delete(name string) (*Response, error) {
-	resp, err := c.delete_(fmt.Sprintf("containers/%s", name), nil)
+// Restore resets a container to one of its snapshots, along with its running
+// state if stateful is set.
+func (c *Client) Restore(name string, snapshotName string, stateful bool) (*Response, error) {
+	body := Jmap{"action": Restore, "snapshot": snapshotName, "stateful": stateful}
+	resp, err := c.put(fmt.Sprintf("containers/%s/state", name), body)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ParseError(resp); err != nil {
+		return nil, err
+	}
+
+	if resp.Type != Async {
+		return nil, fmt.Errorf("got non-async response from restore!")
+	}
+
+	return resp, nil
+}
+
+func (c *Client) Delete(name string, force bool) (*Response, error) {
+	resp, err := c.delete_(fmt.Sprintf("containers/%s", name), Jmap{"force": force})
 	if err != nil {
 		return nil, err
 	}
@@ -539,6 +576,196 @@ func (c *Client) Delete(name string) (*Response, error) {
 	return resp, nil
 }
 
+func (c *Client) Rename(name string, newName string) (*Response, error) {
+	resp, err := c.post(fmt.Sprintf("containers/%s", name), Jmap{"name": newName})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ParseError(resp); err != nil {
+		return nil, err
+	}
+
+	if resp.Type != Async {
+		return nil, fmt.Errorf("got non-async response from rename!")
+	}
+
+	return resp, nil
+}
+
+// SourceUnreachable starts the error a migration fails with when the target
+// couldn't connect to the source, which relaying the container through the
+// client works around.
+const SourceUnreachable = "couldn't reach the migration source"
+
+// IsSourceUnreachable tells whether MigrateTo or CopyTo failed because the
+// target couldn't connect to the source, rather than for any other reason.
+func IsSourceUnreachable(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), SourceUnreachable)
+}
+
+// MigrateTo moves the container name to the daemon dest talks to, as
+// newName. dest pulls the container straight from c's daemon, which only
+// deletes it once dest has created it. Running containers are migrated
+// live and keep running on c's daemon if anything goes wrong.
+func (c *Client) MigrateTo(dest *Client, name string, newName string) error {
+	return c.transfer(dest, name, fmt.Sprintf("containers/%s", name), Jmap{"migration": true}, newName, false, nil)
+}
+
+// CopyTo copies the container or snapshot (as container/snapshot) source to
+// the daemon dest talks to, as newName, with the container's snapshots if
+// snapshots is set. dest pulls the copy straight from c's daemon, and the
+// source is left alone, even if it is running.
+func (c *Client) CopyTo(dest *Client, source string, newName string, snapshots bool) error {
+	name, resource, body := copySource(source, snapshots)
+	return c.transfer(dest, name, resource, body, newName, true, nil)
+}
+
+// copySource returns the container a copy of source comes from, and what to
+// post where to get it ready.
+func copySource(source string, snapshots bool) (string, string, Jmap) {
+	fields := strings.SplitN(source, "/", 2)
+	if len(fields) == 2 {
+		return fields[0], fmt.Sprintf("containers/%s/snapshots/%s", fields[0], fields[1]), Jmap{"migration": true}
+	}
+
+	return source, fmt.Sprintf("containers/%s", source), Jmap{"migration": true, "copy": true, "snapshots": snapshots}
+}
+
+// transfer has dest get the container name from c's daemon, once c's
+// daemon is told to get it ready by posting body to resource. If relay is
+// set, the client relays it, telling relay how far along it is.
+func (c *Client) transfer(dest *Client, name string, resource string, body Jmap, newName string, copying bool, relay TransferProgress) error {
+	if newName == "" {
+		newName = name
+	}
+
+	ct, err := c.ContainerStatus(name)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.post(resource, body)
+	if err != nil {
+		return err
+	}
+
+	if err := ParseError(resp); err != nil {
+		return err
+	}
+
+	if resp.Type != Async {
+		return fmt.Errorf("got non-async response from migrate!")
+	}
+
+	op, err := c.GetOperation(resp.Operation)
+	if err != nil {
+		return err
+	}
+
+	md := Jmap{}
+	if err := json.Unmarshal(op.Metadata, &md); err != nil {
+		return err
+	}
+
+	secret, err := md.GetString("secret")
+	if err != nil {
+		c.abandon(resp.Operation)
+		return err
+	}
+
+	live, _ := md.GetBool("live")
+	source := Jmap{"type": "migration", "copy": copying, "live": live}
+	if relay != nil {
+		source["relay"] = true
+	} else {
+		source["name"] = name
+		source["secret"] = secret
+		source["certificate"], err = md.GetString("certificate")
+		if err != nil {
+			c.abandon(resp.Operation)
+			return err
+		}
+
+		addr, err := c.migrationAddr(md)
+		if err != nil {
+			c.abandon(resp.Operation)
+			return err
+		}
+		source["url"] = "https://" + addr
+	}
+
+	create := Jmap{"name": newName, "source": source, "profiles": ct.Profiles, "config": ct.Config}
+	dresp, err := dest.post("containers", create)
+	if err == nil {
+		err = ParseError(dresp)
+	}
+	if err != nil {
+		c.abandon(resp.Operation)
+		return err
+	}
+
+	if relay != nil {
+		err = c.relayMigration(dest, name, newName, secret, live, relay)
+		if err != nil {
+			dest.abortRelay(newName)
+		}
+	}
+
+	if destErr := dest.WaitForSuccess(dresp.Operation); err == nil {
+		err = destErr
+	}
+
+	/*
+	 * Targets tell the source how it went, unless they couldn't reach it
+	 * at all. We do when we relay.
+	 */
+	if relay != nil {
+		if reportErr := c.reportMigration(name, secret, err); err == nil {
+			err = reportErr
+		}
+	}
+
+	if err != nil {
+		c.abandon(resp.Operation)
+		return err
+	}
+
+	return c.WaitForSuccess(resp.Operation)
+}
+
+// abandon cancels a migration on its source, and waits for the source to be
+// done with it, so that the container is back to how it was.
+func (c *Client) abandon(op string) {
+	c.CancelOperation(op)
+	c.WaitFor(op)
+}
+
+// migrationAddr is where the target of a migration can reach the source:
+// the address we reach it at, or the one it listens on if we use its unix
+// socket.
+func (c *Client) migrationAddr(md Jmap) (string, error) {
+	if c.Remote != nil {
+		return c.Remote.Addr, nil
+	}
+
+	addr, err := md.GetString("addr")
+	if err != nil {
+		return "", err
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		return "", fmt.Errorf("the source listens on %s, add it as a remote to migrate containers off it", addr)
+	}
+
+	return addr, nil
+}
+
 func (c *Client) ContainerStatus(name string) (*Container, error) {
 	ct := Container{}
 
@@ -654,6 +881,31 @@ func (c *Client) WaitFor(waitURL string) (*Operation, error) {
 	return resp.MetadataAsOperation()
 }
 
+// GetOperation returns an operation as it currently stands, e.g. to read
+// the metadata of one still running.
+func (c *Client) GetOperation(id string) (*Operation, error) {
+	resp, err := c.get(strings.TrimPrefix(id, "/"+APIVersion+"/"))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ParseError(resp); err != nil {
+		return nil, err
+	}
+
+	return resp.MetadataAsOperation()
+}
+
+// CancelOperation cancels a running operation.
+func (c *Client) CancelOperation(id string) error {
+	resp, err := c.delete_(strings.TrimPrefix(id, "/"+APIVersion+"/"), nil)
+	if err != nil {
+		return err
+	}
+
+	return ParseError(resp)
+}
+
 func (c *Client) WaitForSuccess(waitURL string) error {
 	op, err := c.WaitFor(waitURL)
 	if err != nil {
@@ -667,8 +919,11 @@ func (c *Client) WaitForSuccess(waitURL string) error {
 	return op.GetError()
 }
 
-func (c *Client) Snapshot(container string, snapshotName string, stateful bool) (*Response, error) {
-	body := Jmap{"name": snapshotName, "stateful": stateful}
+func (c *Client) Snapshot(container string, snapshotName string, stateful bool, description string, expiryDate int64) (*Response, error) {
+	body := Jmap{"name": snapshotName, "stateful": stateful, "description": description}
+	if expiryDate != 0 {
+		body["expiry_date"] = expiryDate
+	}
 	resp, err := c.post(fmt.Sprintf("containers/%s/snapshots", container), body)
 	if err != nil {
 		return nil, err
@@ -684,3 +939,423 @@ func (c *Client) Snapshot(container string, snapshotName string, stateful bool)
 
 	return resp, nil
 }
+
+func (c *Client) ListSnapshots(container string) ([]SnapshotInfo, error) {
+	resp, err := c.get(fmt.Sprintf("containers/%s/snapshots", container))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ParseError(resp); err != nil {
+		return nil, err
+	}
+
+	if resp.Type != Sync {
+		return nil, fmt.Errorf("got non-sync response from snapshot list!")
+	}
+
+	result := make([]SnapshotInfo, 0)
+	if err := json.Unmarshal(resp.Metadata, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (c *Client) GetSnapshot(container string, snapshotName string) (*SnapshotInfo, error) {
+	info := SnapshotInfo{}
+
+	resp, err := c.get(fmt.Sprintf("containers/%s/snapshots/%s", container, snapshotName))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ParseError(resp); err != nil {
+		return nil, err
+	}
+
+	if resp.Type != Sync {
+		return nil, fmt.Errorf("got non-sync response from snapshot get!")
+	}
+
+	if err := json.Unmarshal(resp.Metadata, &info); err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+func (c *Client) RenameSnapshot(container string, snapshotName string, newName string) (*Response, error) {
+	resp, err := c.post(fmt.Sprintf("containers/%s/snapshots/%s", container, snapshotName), Jmap{"name": newName})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ParseError(resp); err != nil {
+		return nil, err
+	}
+
+	if resp.Type != Async {
+		return nil, fmt.Errorf("got non-async response from snapshot rename!")
+	}
+
+	return resp, nil
+}
+
+// UpdateSnapshot sets whether a snapshot is protected and when it expires,
+// zero meaning never.
+func (c *Client) UpdateSnapshot(container string, snapshotName string, protected bool, expiryDate int64) error {
+	body := Jmap{"protected": protected, "expiry_date": expiryDate}
+	resp, err := c.put(fmt.Sprintf("containers/%s/snapshots/%s", container, snapshotName), body)
+	if err != nil {
+		return err
+	}
+
+	return ParseError(resp)
+}
+
+func (c *Client) DeleteSnapshot(container string, snapshotName string, force bool) (*Response, error) {
+	resp, err := c.delete_(fmt.Sprintf("containers/%s/snapshots/%s", container, snapshotName), Jmap{"force": force})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ParseError(resp); err != nil {
+		return nil, err
+	}
+
+	if resp.Type != Async {
+		return nil, fmt.Errorf("got non-async response from snapshot delete!")
+	}
+
+	return resp, nil
+}
+
+func (c *Client) ListImages() ([]string, error) {
+	resp, err := c.get("images")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ParseError(resp); err != nil {
+		return nil, err
+	}
+
+	if resp.Type != Sync {
+		return nil, fmt.Errorf("got non-sync response from images get!")
+	}
+
+	urls := make([]string, 0)
+	if err := json.Unmarshal(resp.Metadata, &urls); err != nil {
+		return nil, err
+	}
+
+	result := make([]string, 0, len(urls))
+	for _, url := range urls {
+		result = append(result, path.Base(url))
+	}
+
+	return result, nil
+}
+
+func (c *Client) GetImageInfo(image string) (*ImageInfo, error) {
+	info := ImageInfo{}
+
+	resp, err := c.get(fmt.Sprintf("images/%s", image))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ParseError(resp); err != nil {
+		return nil, err
+	}
+
+	if resp.Type != Sync {
+		return nil, fmt.Errorf("got non-sync response from image get!")
+	}
+
+	if err := json.Unmarshal(resp.Metadata, &info); err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+/*
+ * Download an image tarball. The fingerprint is the one the server claims
+ * for it; it's up to the caller to check the content against it.
+ */
+func (c *Client) ExportImage(image string) (string, io.ReadCloser, error) {
+	uri := c.url(APIVersion, "images", image, "export")
+
+	r, err := c.http.Get(uri)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if r.StatusCode != 200 {
+		resp, err := ParseResponse(r)
+		if err != nil {
+			return "", nil, err
+		}
+
+		return "", nil, ParseError(resp)
+	}
+
+	fingerprint := r.Header.Get("X-LXD-fingerprint")
+	if fingerprint == "" {
+		r.Body.Close()
+		return "", nil, fmt.Errorf("missing fingerprint in image export")
+	}
+
+	return fingerprint, r.Body, nil
+}
+
+// ExportContainer returns an OCI image layout of a stopped container, or of
+// one of its snapshots when source is "<container>/<snapshot>", as an
+// uncompressed tarball.
+func (c *Client) ExportContainer(source string) (io.ReadCloser, error) {
+	fields := strings.SplitN(source, "/", 2)
+	uri := c.url(APIVersion, "containers", fields[0], "export")
+	if len(fields) == 2 {
+		uri = c.url(APIVersion, "containers", fields[0], "snapshots", fields[1], "export")
+	}
+
+	r, err := c.http.Get(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.StatusCode != 200 {
+		resp, err := ParseResponse(r)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, ParseError(resp)
+	}
+
+	return r.Body, nil
+}
+
+/* Upload an image tarball; the fingerprint is in the operation's metadata */
+func (c *Client) ImportImage(tarball io.Reader, public bool) (*Response, error) {
+	uri := c.url(APIVersion, "images")
+
+	req, err := http.NewRequest("PUT", uri, tarball)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if public {
+		req.Header.Set("X-LXD-public", "1")
+	}
+
+	raw, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := ParseResponse(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ParseError(resp); err != nil {
+		return nil, err
+	}
+
+	if resp.Type != Async {
+		return nil, fmt.Errorf("Non-async response from image import!")
+	}
+
+	return resp, nil
+}
+
+func (c *Client) DeleteImage(image string) (*Response, error) {
+	resp, err := c.delete_(fmt.Sprintf("images/%s", image), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ParseError(resp); err != nil {
+		return nil, err
+	}
+
+	if resp.Type != Async {
+		return nil, fmt.Errorf("got non-async response from image delete!")
+	}
+
+	return resp, nil
+}
+
+func (c *Client) ListAliases() ([]string, error) {
+	resp, err := c.get("images/aliases")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ParseError(resp); err != nil {
+		return nil, err
+	}
+
+	if resp.Type != Sync {
+		return nil, fmt.Errorf("got non-sync response from aliases get!")
+	}
+
+	urls := make([]string, 0)
+	if err := json.Unmarshal(resp.Metadata, &urls); err != nil {
+		return nil, err
+	}
+
+	prefix := fmt.Sprintf("/%s/images/aliases/", APIVersion)
+	result := make([]string, 0, len(urls))
+	for _, url := range urls {
+		result = append(result, strings.TrimPrefix(url, prefix))
+	}
+
+	return result, nil
+}
+
+func (c *Client) GetAlias(name string) (*ImageAlias, error) {
+	alias := ImageAlias{}
+
+	resp, err := c.get(fmt.Sprintf("images/aliases/%s", name))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ParseError(resp); err != nil {
+		return nil, err
+	}
+
+	if resp.Type != Sync {
+		return nil, fmt.Errorf("got non-sync response from alias get!")
+	}
+
+	if err := json.Unmarshal(resp.Metadata, &alias); err != nil {
+		return nil, err
+	}
+
+	return &alias, nil
+}
+
+func (c *Client) CreateAlias(name string, target string, description string) error {
+	body := Jmap{"name": name, "target": target, "description": description}
+	resp, err := c.post("images/aliases", body)
+	if err != nil {
+		return err
+	}
+
+	return ParseError(resp)
+}
+
+func (c *Client) RenameAlias(name string, newName string) error {
+	resp, err := c.post(fmt.Sprintf("images/aliases/%s", name), Jmap{"name": newName})
+	if err != nil {
+		return err
+	}
+
+	return ParseError(resp)
+}
+
+func (c *Client) DeleteAlias(name string) error {
+	resp, err := c.delete_(fmt.Sprintf("images/aliases/%s", name), nil)
+	if err != nil {
+		return err
+	}
+
+	return ParseError(resp)
+}
+
+/*
+ * Turn an image reference, which may be an alias, into a fingerprint. Anything
+ * the daemon has no alias for is assumed to be a fingerprint; failing to ask
+ * it is an error.
+ */
+func (c *Client) ResolveImage(image string) (string, error) {
+	resp, err := c.get(fmt.Sprintf("images/aliases/%s", image))
+	if err != nil {
+		return "", err
+	}
+
+	if resp.Type == Error && resp.Code == 404 {
+		return image, nil
+	}
+
+	if err := ParseError(resp); err != nil {
+		return "", err
+	}
+
+	alias := ImageAlias{}
+	if err := json.Unmarshal(resp.Metadata, &alias); err != nil {
+		return "", err
+	}
+
+	return alias.Target, nil
+}
+
+/*
+ * Turn a container, or a snapshot given as "<container>/<snapshot>", into an
+ * image. The fingerprint is in the operation's metadata once it's done.
+ */
+func (c *Client) Publish(source string, public bool, properties map[string]string) (*Response, error) {
+	body := Jmap{
+		"source":     Jmap{"type": "container", "name": source},
+		"public":     public,
+		"properties": properties,
+	}
+
+	resp, err := c.put("images", body)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ParseError(resp); err != nil {
+		return nil, err
+	}
+
+	if resp.Type != Async {
+		return nil, fmt.Errorf("Non-async response from publish!")
+	}
+
+	return resp, nil
+}
+
+/*
+ * Build an image from a recipe. The fingerprint of the new image and the
+ * build log are in the operation's metadata.
+ */
+func (c *Client) BuildImage(recipe *ImageRecipe) (*Response, error) {
+	buf, err := json.Marshal(recipe)
+	if err != nil {
+		return nil, err
+	}
+
+	source := Jmap{}
+	if err := json.Unmarshal(buf, &source); err != nil {
+		return nil, err
+	}
+	source["type"] = "recipe"
+
+	body := Jmap{
+		"source":     source,
+		"public":     recipe.Public,
+		"properties": recipe.Properties,
+	}
+
+	resp, err := c.put("images", body)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ParseError(resp); err != nil {
+		return nil, err
+	}
+
+	if resp.Type != Async {
+		return nil, fmt.Errorf("Non-async response from image build!")
+	}
+
+	return resp, nil
+}
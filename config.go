@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 )
@@ -32,8 +33,51 @@ type Config struct {
 }
 
 // RemoteConfig holds details for communication with a remote daemon.
+// AlwaysRelay makes the client download images itself rather than have the
+// daemon fetch them, either for all the images going to that daemon or all
+// those coming from that image server. Insecure allows an image server to be
+// reached over plain http.
 type RemoteConfig struct {
-	Addr string `yaml:"addr"`
+	Addr        string `yaml:"addr"`
+	AlwaysRelay bool   `yaml:"always-relay,omitempty"`
+	Insecure    bool   `yaml:"insecure,omitempty"`
+}
+
+// ImagesURL is the image server used for the implicit "images" remote.
+const ImagesURL = "https+lxc-images://images.linuxcontainers.org"
+
+// IsImageServer returns whether the remote address points to an lxc image
+// server rather than an lxd daemon.
+func IsImageServer(addr string) bool {
+	return strings.Contains(addr, "+lxc-images://")
+}
+
+// ImageServerURL returns the image server url for the named remote.
+func (c *Config) ImageServerURL(remote string) (string, error) {
+	if r, ok := c.Remotes[remote]; ok {
+		if !IsImageServer(r.Addr) {
+			return "", fmt.Errorf("remote %s is not an image server", remote)
+		}
+		return r.Addr, nil
+	}
+
+	if remote == "images" {
+		return ImagesURL, nil
+	}
+
+	return "", fmt.Errorf("unknown remote name: %q", remote)
+}
+
+// AlwaysRelay returns whether images going to or coming from the named
+// remote must be relayed by the client.
+func (c *Config) AlwaysRelay(remote string) bool {
+	return c.Remotes[remote].AlwaysRelay
+}
+
+// Insecure returns whether the named remote is an image server the user
+// marked as insecure.
+func (c *Config) Insecure(remote string) bool {
+	return c.Remotes[remote].Insecure
 }
 
 func configPath(file string) string {
@@ -17,7 +17,7 @@ type Container struct {
 	Name     string          `json:"name"`
 	Profiles []string        `json:"profiles"`
 	Config   []Jmap          `json:"config"`
-	Userdata []byte          `json:"config"`
+	Userdata []byte          `json:"userdata"`
 	Status   ContainerStatus `json:"status"`
 }
 
@@ -33,6 +33,19 @@ func CtoD(c *lxc.Container) Container {
 	return d
 }
 
+// SnapshotInfo describes a snapshot of a container. Size is the disk space
+// its rootfs and running state take. Protected snapshots can only be deleted
+// by force, and snapshots with an expiry date are deleted once it's past.
+type SnapshotInfo struct {
+	Name         string `json:"name"`
+	CreationDate int64  `json:"creation_date"`
+	Size         int64  `json:"size"`
+	Stateful     bool   `json:"stateful"`
+	Description  string `json:"description"`
+	Protected    bool   `json:"protected"`
+	ExpiryDate   int64  `json:"expiry_date,omitempty"`
+}
+
 type ContainerAction string
 
 const (
@@ -41,4 +54,5 @@ const (
 	Restart  ContainerAction = "restart"
 	Freeze   ContainerAction = "freeze"
 	Unfreeze ContainerAction = "unfreeze"
+	Restore  ContainerAction = "restore"
 )
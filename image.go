@@ -0,0 +1,52 @@
+package lxd
+
+// ImageInfo describes an image in a daemon's image store. Cached images were
+// fetched from an image server, Source telling which one, and are removed
+// once expired or unused for a while. Verified tells whether their
+// signatures were checked against the daemon's trusted keys.
+type ImageInfo struct {
+	Fingerprint  string            `json:"fingerprint"`
+	Size         int64             `json:"size"`
+	Architecture string            `json:"architecture"`
+	CreationDate int64             `json:"creation_date"`
+	UploadDate   int64             `json:"upload_date"`
+	LastUsedDate int64             `json:"last_used_date"`
+	Public       bool              `json:"public"`
+	Cached       bool              `json:"cached"`
+	Verified     bool              `json:"verified"`
+	Source       string            `json:"source,omitempty"`
+	ExpiryDate   int64             `json:"expiry_date,omitempty"`
+	Properties   map[string]string `json:"properties"`
+}
+
+// ImageAlias gives an image a human readable name, e.g. "ubuntu/trusty".
+type ImageAlias struct {
+	Name        string `json:"name"`
+	Target      string `json:"target"`
+	Description string `json:"description"`
+}
+
+// ImageRecipe describes how to build an image: a container is created from
+// the Base image, the Files are pushed into it, the Commands run in it, and
+// the result is published as the new image.
+type ImageRecipe struct {
+	Base     string       `json:"base" yaml:"base"`
+	Files    []RecipeFile `json:"files" yaml:"files"`
+	Commands []string     `json:"commands" yaml:"commands"`
+
+	// Properties, Public and Alias describe the resulting image.
+	Properties map[string]string `json:"-" yaml:"properties"`
+	Public     bool              `json:"-" yaml:"public"`
+	Alias      string            `json:"-" yaml:"alias"`
+}
+
+// RecipeFile is a file pushed into the container an image is built in. In
+// recipe files its content is read from Source, a path on the client.
+type RecipeFile struct {
+	Path    string `json:"path" yaml:"path"`
+	Source  string `json:"-" yaml:"source"`
+	Content []byte `json:"content" yaml:"-"`
+	Mode    string `json:"mode" yaml:"mode"`
+	UID     int    `json:"uid" yaml:"uid"`
+	GID     int    `json:"gid" yaml:"gid"`
+}
@@ -45,3 +45,21 @@ func (m Jmap) GetBool(key string) (bool, error) {
 		return val, nil
 	}
 }
+
+func (m Jmap) GetStringList(key string) ([]string, error) {
+	if val, ok := m[key]; !ok {
+		return nil, fmt.Errorf("Response was missing `%s`", key)
+	} else if val, ok := val.([]interface{}); !ok {
+		return nil, fmt.Errorf("`%s` was not a list, got %T", key, m[key])
+	} else {
+		ret := make([]string, 0, len(val))
+		for _, elt := range val {
+			s, ok := elt.(string)
+			if !ok {
+				return nil, fmt.Errorf("`%s` contains a non-string element", key)
+			}
+			ret = append(ret, s)
+		}
+		return ret, nil
+	}
+}
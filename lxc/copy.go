@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lxc/lxd"
+	"github.com/lxc/lxd/internal/gnuflag"
+)
+
+type copyCmd struct {
+	snapshots bool
+}
+
+const copyUsage = `
+Copy a container or snapshot into a new container.
+
+lxc copy [--snapshots] [remote:]<container>[/<snapshot>] [remote:][<name>]
+
+Within a remote, the container must be stopped, snapshots can be copied at
+any time. Between remotes, the new container is pulled straight from the
+source remote, which keeps the container as it is, even if it is running;
+it is named like the source container unless given a name. Copies get the
+source's profiles and config, but their own hostname and MAC addresses.
+Snapshots of the container are copied along with it between remotes if
+--snapshots is given. If the target remote can't reach the source one, or
+either remote was added with --always-relay, the client relays the copy
+instead.
+`
+
+func (c *copyCmd) usage() string {
+	return copyUsage
+}
+
+func (c *copyCmd) flags() {
+	gnuflag.BoolVar(&c.snapshots, "snapshots", false, "Copy the container's snapshots too (between remotes only)")
+}
+
+func (c *copyCmd) run(config *lxd.Config, args []string) error {
+	if len(args) != 2 {
+		return errArgs
+	}
+
+	d, source, err := lxd.NewClient(config, args[0])
+	if err != nil {
+		return err
+	}
+
+	if remoteOf(config, args[0]) != remoteOf(config, args[1]) {
+		dest, name, err := lxd.NewClient(config, args[1])
+		if err != nil {
+			return err
+		}
+
+		if !config.AlwaysRelay(remoteOf(config, args[0])) && !config.AlwaysRelay(remoteOf(config, args[1])) {
+			err := d.CopyTo(dest, source, name, c.snapshots)
+			if !lxd.IsSourceUnreachable(err) {
+				return err
+			}
+
+			fmt.Fprintf(os.Stderr, "Copying the container failed (%s), relaying it.\n", err)
+		}
+
+		progress := relayProgress{}
+		defer progress.done()
+		return d.RelayCopyTo(dest, source, name, c.snapshots, progress.update)
+	}
+
+	if c.snapshots {
+		return fmt.Errorf("Snapshots can only be copied along between remotes for now")
+	}
+
+	fields := strings.SplitN(args[1], ":", 2)
+	name := fields[len(fields)-1]
+	if name == "" {
+		return fmt.Errorf("%s is already on %s", source, remoteOf(config, args[1]))
+	}
+
+	resp, err := d.Copy(source, name)
+	if err != nil {
+		return err
+	}
+
+	return d.WaitForSuccess(resp.Operation)
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"strings"
 
 	"github.com/lxc/lxd"
 )
@@ -9,9 +11,20 @@ import (
 type createCmd struct{}
 
 const createUsage = `
-lxc create images:ubuntu <name>
+lxc create [<remote>:]<image> [<name>]
 
-Creates a container using the specified image and name
+Creates a container using the specified image and name.
+
+Images from an image server are given as distro[/release[/arch[/variant]]],
+e.g. images:debian/jessie/i386. Missing releases and architectures default
+to the recommended ones for the host. Images without a remote are taken
+from the image store of the daemon the container is created on, and may be
+given by fingerprint or alias.
+
+Images from an image server are downloaded by the daemon; if that fails, or
+either remote was added with --always-relay, the client downloads the image
+and relays it to the daemon instead. Plain http image servers are only used
+if they were added with --insecure.
 `
 
 func (c *createCmd) usage() string {
@@ -29,8 +42,22 @@ func (c *createCmd) run(config *lxd.Config, args []string) error {
 		return errArgs
 	}
 
-	if args[0] != "images:ubuntu" {
-		return fmt.Errorf("Only the default ubuntu image is supported. Try `lxc create images:ubuntu foo`.")
+	/*
+	 * Images without a remote are looked up in the image store of the
+	 * daemon the container is created on.
+	 */
+	image := strings.SplitN(args[0], ":", 2)
+	imageURL := ""
+	if len(image) == 2 {
+		if image[1] == "" {
+			return fmt.Errorf("Invalid image %s. Try `lxc create images:ubuntu foo`.", args[0])
+		}
+
+		var err error
+		imageURL, err = config.ImageServerURL(image[0])
+		if err != nil {
+			return err
+		}
 	}
 
 	var resourceRef string
@@ -45,8 +72,43 @@ func (c *createCmd) run(config *lxd.Config, args []string) error {
 		return err
 	}
 
-	// TODO: implement the syntax for supporting other image types/remotes
-	resp, err := d.Create(name)
+	if imageURL == "" {
+		fingerprint, err := d.ResolveImage(image[0])
+		if err != nil {
+			return err
+		}
+
+		resp, err := d.CreateFromImage(name, fingerprint)
+		if err != nil {
+			return err
+		}
+
+		return d.WaitForSuccess(resp.Operation)
+	}
+
+	/*
+	 * Have the daemon download the image unless told otherwise, falling
+	 * back to downloading it ourselves if it can't.
+	 */
+	if !config.AlwaysRelay(image[0]) && !config.AlwaysRelay(remoteOf(config, resourceRef)) {
+		resp, err := d.Create(name, imageURL, image[1], config.Insecure(image[0]))
+		if err != nil {
+			return err
+		}
+
+		err = d.WaitForSuccess(resp.Operation)
+		if err == nil {
+			return nil
+		}
+
+		fmt.Fprintf(os.Stderr, "Creating the container failed (%s), relaying the image.\n", err)
+	}
+
+	if err := d.RelayImage(imageURL, image[1], config.Insecure(image[0])); err != nil {
+		return err
+	}
+
+	resp, err := d.CreateRelayed(name, imageURL, image[1], config.Insecure(image[0]))
 	if err != nil {
 		return err
 	}
@@ -4,23 +4,29 @@ import (
 	"fmt"
 
 	"github.com/lxc/lxd"
+	"github.com/lxc/lxd/internal/gnuflag"
 	"gopkg.in/lxc/go-lxc.v2"
 )
 
-type deleteCmd struct{}
+type deleteCmd struct {
+	force bool
+}
 
 const deleteUsage = `
-lxc delete <resource>
+lxc delete <resource> [--force]
 
 Destroy a resource (e.g. container) and any attached data (configuration,
-snapshots, ...).
+snapshots, ...). Containers with protected snapshots are only destroyed if
+--force is given.
 `
 
 func (c *deleteCmd) usage() string {
 	return deleteUsage
 }
 
-func (c *deleteCmd) flags() {}
+func (c *deleteCmd) flags() {
+	gnuflag.BoolVar(&c.force, "force", false, "Delete the container even if it has protected snapshots")
+}
 
 func (c *deleteCmd) run(config *lxd.Config, args []string) error {
 	if len(args) != 1 {
@@ -38,6 +44,20 @@ func (c *deleteCmd) run(config *lxd.Config, args []string) error {
 		return err
 	}
 
+	/* Don't stop a container we won't be allowed to delete. */
+	if !c.force {
+		snapshots, err := d.ListSnapshots(name)
+		if err != nil {
+			return err
+		}
+
+		for _, snapshot := range snapshots {
+			if snapshot.Protected {
+				return fmt.Errorf("%s has protected snapshots, use --force to delete it anyway", name)
+			}
+		}
+	}
+
 	if ct.State() != lxc.STOPPED {
 		resp, err := d.Action(name, lxd.Stop, -1, true)
 		if err != nil {
@@ -54,7 +74,7 @@ func (c *deleteCmd) run(config *lxd.Config, args []string) error {
 		}
 	}
 
-	resp, err := d.Delete(name)
+	resp, err := d.Delete(name, c.force)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/lxc/lxd"
+)
+
+type exportCmd struct{}
+
+const exportUsage = `
+Export a container or snapshot as an OCI image layout.
+
+lxc export [remote:]<container>[/<snapshot>] [target]
+
+The container must be stopped, snapshots can be exported at any time. If
+target ends in .tar, the layout is written there as a tarball, otherwise it
+is unpacked into the target directory. The target defaults to
+<container>.tar.
+`
+
+func (c *exportCmd) usage() string {
+	return exportUsage
+}
+
+func (c *exportCmd) flags() {}
+
+/*
+ * Unpack the layout tarball sent by the daemon into dir. It only ever
+ * contains regular files.
+ */
+func unpackLayout(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			return fmt.Errorf("unexpected entry %s in the layout", hdr.Name)
+		}
+
+		p := path.Join(dir, path.Clean("/"+hdr.Name))
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			return err
+		}
+
+		f, err := os.Create(p)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *exportCmd) run(config *lxd.Config, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errArgs
+	}
+
+	d, source, err := lxd.NewClient(config, args[0])
+	if err != nil {
+		return err
+	}
+
+	target := strings.Replace(source, "/", "-", -1) + ".tar"
+	if len(args) == 2 {
+		target = args[1]
+	}
+
+	body, err := d.ExportContainer(source)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if !strings.HasSuffix(target, ".tar") {
+		if err := unpackLayout(body, target); err != nil {
+			return err
+		}
+
+		fmt.Printf("Container exported to: %s\n", target)
+		return nil
+	}
+
+	f, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, body)
+	f.Close()
+	if err != nil {
+		os.Remove(target)
+		return err
+	}
+
+	fmt.Printf("Container exported to: %s\n", target)
+	return nil
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/lxc/lxd"
+	"github.com/lxc/lxd/internal/gnuflag"
+	"gopkg.in/yaml.v2"
+)
+
+type imageCmd struct {
+	public bool
+}
+
+const imageUsage = `
+Manage images.
+
+lxc image import <tarball> [remote:]    Import an image tarball, --public
+                                        makes it visible to everyone.
+lxc image list [remote:]                List the images in the image store.
+lxc image show [remote:]<image>         Show an image's metadata.
+lxc image delete [remote:]<image>       Delete an image.
+lxc image build <recipe> [remote:]      Build an image from a recipe.
+lxc image export [remote:]<image> [target]
+                                        Download an image's tarball, by
+                                        default to <fingerprint>.tar.gz.
+
+lxc image alias create [remote:]<alias> <image> [<description>]
+lxc image alias delete [remote:]<alias>
+lxc image alias rename [remote:]<alias> <new alias>
+lxc image alias list [remote:]
+
+Images are referred to by their fingerprint, which may be abbreviated, or
+any of their aliases. Public images can be listed and shown by untrusted
+clients.
+
+Recipes are yaml files like:
+
+  base: ubuntu                      # alias or fingerprint of the base image
+  alias: ubuntu/web                 # optional alias for the new image
+  public: false
+  properties:
+    description: Ubuntu with nginx
+  files:
+    - path: /etc/motd
+      source: motd                  # relative to the recipe
+      mode: "0644"
+  commands:
+    - apt-get install -y nginx
+`
+
+func (c *imageCmd) usage() string {
+	return imageUsage
+}
+
+func (c *imageCmd) flags() {
+	gnuflag.BoolVar(&c.public, "public", false, "Make the image available to untrusted clients")
+}
+
+func (c *imageCmd) run(config *lxd.Config, args []string) error {
+	if len(args) < 1 {
+		return errArgs
+	}
+
+	switch args[0] {
+	case "import":
+		if len(args) < 2 || len(args) > 3 {
+			return errArgs
+		}
+
+		remote := ""
+		if len(args) == 3 {
+			remote = args[2]
+		}
+
+		f, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		d, _, err := lxd.NewClient(config, remote)
+		if err != nil {
+			return err
+		}
+
+		resp, err := d.ImportImage(f, c.public)
+		if err != nil {
+			return err
+		}
+
+		op, err := d.WaitFor(resp.Operation)
+		if err != nil {
+			return err
+		}
+
+		if op.Result != lxd.Success {
+			return op.GetError()
+		}
+
+		md, err := op.MetadataAsMap()
+		if err != nil {
+			return err
+		}
+
+		fingerprint, err := md.GetString("fingerprint")
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Image imported with fingerprint: %s\n", fingerprint)
+		return nil
+
+	case "list":
+		if len(args) > 2 {
+			return errArgs
+		}
+
+		remote := ""
+		if len(args) == 2 {
+			remote = args[1]
+		}
+
+		d, _, err := lxd.NewClient(config, remote)
+		if err != nil {
+			return err
+		}
+
+		images, err := d.ListImages()
+		if err != nil {
+			return err
+		}
+
+		sort.Strings(images)
+		for _, image := range images {
+			fmt.Println(image)
+		}
+		return nil
+
+	case "show":
+		if len(args) != 2 {
+			return errArgs
+		}
+
+		d, image, err := lxd.NewClient(config, args[1])
+		if err != nil {
+			return err
+		}
+
+		fingerprint, err := d.ResolveImage(image)
+		if err != nil {
+			return err
+		}
+
+		info, err := d.GetImageInfo(fingerprint)
+		if err != nil {
+			return err
+		}
+
+		data, err := yaml.Marshal(info)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s", data)
+		return nil
+
+	case "delete":
+		if len(args) != 2 {
+			return errArgs
+		}
+
+		d, image, err := lxd.NewClient(config, args[1])
+		if err != nil {
+			return err
+		}
+
+		fingerprint, err := d.ResolveImage(image)
+		if err != nil {
+			return err
+		}
+
+		resp, err := d.DeleteImage(fingerprint)
+		if err != nil {
+			return err
+		}
+
+		return d.WaitForSuccess(resp.Operation)
+
+	case "build":
+		if len(args) < 2 || len(args) > 3 {
+			return errArgs
+		}
+
+		remote := ""
+		if len(args) == 3 {
+			remote = args[2]
+		}
+
+		d, _, err := lxd.NewClient(config, remote)
+		if err != nil {
+			return err
+		}
+
+		return buildImage(d, args[1], c.public)
+
+	case "export":
+		if len(args) < 2 || len(args) > 3 {
+			return errArgs
+		}
+
+		d, image, err := lxd.NewClient(config, args[1])
+		if err != nil {
+			return err
+		}
+
+		fingerprint, err := d.ResolveImage(image)
+		if err != nil {
+			return err
+		}
+
+		target := ""
+		if len(args) == 3 {
+			target = args[2]
+		}
+
+		return exportImage(d, fingerprint, target)
+
+	case "alias":
+		return c.alias(config, args[1:])
+	}
+
+	return fmt.Errorf("unknown image command %s", args[0])
+}
+
+func (c *imageCmd) alias(config *lxd.Config, args []string) error {
+	if len(args) < 1 {
+		return errArgs
+	}
+
+	switch args[0] {
+	case "create":
+		if len(args) < 3 || len(args) > 4 {
+			return errArgs
+		}
+
+		d, name, err := lxd.NewClient(config, args[1])
+		if err != nil {
+			return err
+		}
+
+		description := ""
+		if len(args) == 4 {
+			description = args[3]
+		}
+
+		return d.CreateAlias(name, args[2], description)
+
+	case "delete":
+		if len(args) != 2 {
+			return errArgs
+		}
+
+		d, name, err := lxd.NewClient(config, args[1])
+		if err != nil {
+			return err
+		}
+
+		return d.DeleteAlias(name)
+
+	case "rename":
+		if len(args) != 3 {
+			return errArgs
+		}
+
+		d, name, err := lxd.NewClient(config, args[1])
+		if err != nil {
+			return err
+		}
+
+		return d.RenameAlias(name, args[2])
+
+	case "list":
+		if len(args) > 2 {
+			return errArgs
+		}
+
+		remote := ""
+		if len(args) == 2 {
+			remote = args[1]
+		}
+
+		d, _, err := lxd.NewClient(config, remote)
+		if err != nil {
+			return err
+		}
+
+		names, err := d.ListAliases()
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			alias, err := d.GetAlias(name)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s -> %s\n", alias.Name, alias.Target)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown alias command %s", args[0])
+}
+
+/*
+ * Download an image into target, or into <fingerprint>.tar.gz in target if
+ * it is a directory, making sure we got what the server said we would.
+ */
+func exportImage(d *lxd.Client, image string, target string) error {
+	fingerprint, body, err := d.ExportImage(image)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if target == "" {
+		target = fingerprint + ".tar.gz"
+	} else if fi, err := os.Stat(target); err == nil && fi.IsDir() {
+		target = path.Join(target, fingerprint+".tar.gz")
+	}
+
+	f, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), body)
+	f.Close()
+	if err != nil {
+		os.Remove(target)
+		return err
+	}
+
+	actual := fmt.Sprintf("%x", hash.Sum(nil))
+	if actual != fingerprint {
+		os.Remove(target)
+		return fmt.Errorf("fingerprint mismatch: got %s, expected %s", actual, fingerprint)
+	}
+
+	fmt.Printf("Image exported to: %s\n", target)
+	return nil
+}
+
+/*
+ * Build an image from the recipe file, printing the build log.
+ */
+func buildImage(d *lxd.Client, recipeFile string, public bool) error {
+	data, err := ioutil.ReadFile(recipeFile)
+	if err != nil {
+		return err
+	}
+
+	recipe := lxd.ImageRecipe{}
+	if err := yaml.Unmarshal(data, &recipe); err != nil {
+		return err
+	}
+	recipe.Public = recipe.Public || public
+
+	for i, file := range recipe.Files {
+		source := file.Source
+		if !path.IsAbs(source) {
+			source = path.Join(path.Dir(recipeFile), source)
+		}
+
+		recipe.Files[i].Content, err = ioutil.ReadFile(source)
+		if err != nil {
+			return err
+		}
+	}
+
+	resp, err := d.BuildImage(&recipe)
+	if err != nil {
+		return err
+	}
+
+	op, err := d.WaitFor(resp.Operation)
+	if err != nil {
+		return err
+	}
+
+	md, err := op.MetadataAsMap()
+	if err == nil {
+		if log, err := md.GetString("log"); err == nil {
+			fmt.Print(log)
+		}
+	}
+
+	if op.Result != lxd.Success {
+		return op.GetError()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	fingerprint, err := md.GetString("fingerprint")
+	if err != nil {
+		return err
+	}
+
+	if recipe.Alias != "" {
+		if err := d.CreateAlias(recipe.Alias, fingerprint, ""); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Image built with fingerprint: %s\n", fingerprint)
+	return nil
+}
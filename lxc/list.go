@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/lxc/lxd"
 )
@@ -13,8 +14,9 @@ Lists the available resources.
 
 lxc list [resource]
 
-Currently resource must be a defined remote, and list only lists
-the defined containers.
+Lists the containers of a remote, e.g. "lxc list dakara:", with their
+snapshots below them. "lxc list c1" or "lxc list c1:" only lists the
+container c1 of the default remote.
 `
 
 func (c *listCmd) usage() string {
@@ -28,14 +30,18 @@ func (c *listCmd) run(config *lxd.Config, args []string) error {
 		return errArgs
 	}
 
-	var remote string
+	ref := ""
 	if len(args) == 1 {
-		remote = args[0]
-	} else {
-		remote = config.DefaultRemote
+		ref = args[0]
+
+		/* "c1:" is the container c1, unless there's a remote called c1 */
+		fields := strings.SplitN(ref, ":", 2)
+		if _, ok := config.Remotes[fields[0]]; len(fields) == 2 && fields[1] == "" && !ok {
+			ref = fields[0]
+		}
 	}
 
-	d, _, err := lxd.NewClient(config, remote)
+	d, filter, err := lxd.NewClient(config, ref)
 	if err != nil {
 		return err
 	}
@@ -46,7 +52,20 @@ func (c *listCmd) run(config *lxd.Config, args []string) error {
 	}
 
 	for _, ct := range cts {
+		if filter != "" && ct != filter {
+			continue
+		}
+
 		fmt.Println(ct)
+
+		snapshots, err := d.ListSnapshots(ct)
+		if err != nil {
+			return err
+		}
+
+		for _, snapshot := range snapshots {
+			fmt.Printf("  %s/%s\n", ct, snapshotLine(snapshot))
+		}
 	}
 	return nil
 }
@@ -78,6 +78,12 @@ var commands = map[string]command{
 	"delete":   &deleteCmd{},
 	"file":     &fileCmd{},
 	"snapshot": &snapshotCmd{},
+	"restore":  &restoreCmd{},
+	"image":    &imageCmd{},
+	"publish":  &publishCmd{},
+	"export":   &exportCmd{},
+	"move":     &moveCmd{},
+	"copy":     &copyCmd{},
 }
 
 var errArgs = fmt.Errorf("too many subcommand arguments")
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lxc/lxd"
+)
+
+type moveCmd struct{}
+
+const moveUsage = `
+Move a container.
+
+lxc move [remote:]<container> [remote:][<new name>]
+
+Containers are renamed when moved within a remote, and migrated when moved
+to another one, keeping their name unless given a new one. Running
+containers are migrated live (this needs CRIU on both ends), but must be
+stopped to be renamed.
+
+Containers are moved straight from one remote to the other; if the target
+can't reach the source, or either remote was added with --always-relay,
+the client relays them instead.
+`
+
+func (c *moveCmd) usage() string {
+	return moveUsage
+}
+
+func (c *moveCmd) flags() {}
+
+func (c *moveCmd) run(config *lxd.Config, args []string) error {
+	if len(args) != 2 {
+		return errArgs
+	}
+
+	d, name, err := lxd.NewClient(config, args[0])
+	if err != nil {
+		return err
+	}
+
+	if remoteOf(config, args[0]) != remoteOf(config, args[1]) {
+		dest, newName, err := lxd.NewClient(config, args[1])
+		if err != nil {
+			return err
+		}
+
+		if !config.AlwaysRelay(remoteOf(config, args[0])) && !config.AlwaysRelay(remoteOf(config, args[1])) {
+			err := d.MigrateTo(dest, name, newName)
+			if !lxd.IsSourceUnreachable(err) {
+				return err
+			}
+
+			fmt.Fprintf(os.Stderr, "Moving the container failed (%s), relaying it.\n", err)
+		}
+
+		progress := relayProgress{}
+		defer progress.done()
+		return d.RelayMigrateTo(dest, name, newName, progress.update)
+	}
+
+	fields := strings.SplitN(args[1], ":", 2)
+	newName := fields[len(fields)-1]
+	if newName == "" {
+		return fmt.Errorf("%s is already on %s", name, remoteOf(config, args[1]))
+	}
+
+	resp, err := d.Rename(name, newName)
+	if err != nil {
+		return err
+	}
+
+	return d.WaitForSuccess(resp.Operation)
+}
+
+/*
+ * Shows how far along a relayed transfer is, one line per phase.
+ */
+type relayProgress struct {
+	phase string
+}
+
+func (p *relayProgress) update(phase string, bytes int64) {
+	if p.phase != "" && p.phase != phase {
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+	p.phase = phase
+
+	fmt.Fprintf(os.Stderr, "\rRelaying %s: %s", phase, humanSize(bytes))
+}
+
+func (p *relayProgress) done() {
+	if p.phase != "" {
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lxc/lxd"
+	"github.com/lxc/lxd/internal/gnuflag"
+)
+
+type publishCmd struct {
+	public bool
+}
+
+const publishUsage = `
+Publish a container or snapshot as an image.
+
+lxc publish [remote:]<container>[/<snapshot>] [[remote:]<alias>] [--public]
+
+The container must be stopped, snapshots can be published at any time. The
+image is created on the container's remote; if an alias is given, it is
+pointed at the new image.
+`
+
+func (c *publishCmd) usage() string {
+	return publishUsage
+}
+
+func (c *publishCmd) flags() {
+	gnuflag.BoolVar(&c.public, "public", false, "Make the image available to untrusted clients")
+}
+
+/* The remote a resource lives on, with the default one filled in */
+func remoteOf(config *lxd.Config, resource string) string {
+	fields := strings.SplitN(resource, ":", 2)
+	if len(fields) == 1 {
+		return config.DefaultRemote
+	}
+
+	return fields[0]
+}
+
+func (c *publishCmd) run(config *lxd.Config, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errArgs
+	}
+
+	alias := ""
+	if len(args) == 2 {
+		if remoteOf(config, args[0]) != remoteOf(config, args[1]) {
+			return fmt.Errorf("Publishing to a different remote isn't supported yet")
+		}
+
+		fields := strings.SplitN(args[1], ":", 2)
+		alias = fields[len(fields)-1]
+	}
+
+	d, source, err := lxd.NewClient(config, args[0])
+	if err != nil {
+		return err
+	}
+
+	resp, err := d.Publish(source, c.public, nil)
+	if err != nil {
+		return err
+	}
+
+	op, err := d.WaitFor(resp.Operation)
+	if err != nil {
+		return err
+	}
+
+	if op.Result != lxd.Success {
+		return op.GetError()
+	}
+
+	md, err := op.MetadataAsMap()
+	if err != nil {
+		return err
+	}
+
+	fingerprint, err := md.GetString("fingerprint")
+	if err != nil {
+		return err
+	}
+
+	if alias != "" {
+		if err := d.CreateAlias(alias, fingerprint, ""); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Container published with fingerprint: %s\n", fingerprint)
+	return nil
+}
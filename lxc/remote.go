@@ -5,17 +5,29 @@ import (
 	"os"
 
 	"github.com/lxc/lxd"
+	"github.com/lxc/lxd/internal/gnuflag"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
 type remoteCmd struct {
-	httpAddr string
+	httpAddr    string
+	alwaysRelay bool
+	insecure    bool
 }
 
 const remoteUsage = `
 Manage remote lxc servers.
 
 lxc remote add <name> <url>        Add the remote <name> at <url>.
+                                   <url> may be an image server, e.g.
+                                   https+lxc-images://images.linuxcontainers.org
+                                   With --always-relay, images going to or
+                                   coming from <name> are always downloaded
+                                   by the client and relayed to the daemon,
+                                   and containers moved or copied to or from
+                                   <name> are relayed by the client.
+                                   With --insecure, the image server <url>
+                                   may be plain http+lxc-images://.
 lxc remote remove <name>           Remove the remote <name>.
 lxc remote list                    List all remotes.
 lxc remote rename <old> <new>      Rename remote <old> to <new>.
@@ -28,7 +40,10 @@ func (c *remoteCmd) usage() string {
 	return remoteUsage
 }
 
-func (c *remoteCmd) flags() {}
+func (c *remoteCmd) flags() {
+	gnuflag.BoolVar(&c.alwaysRelay, "always-relay", false, "Always have the client relay images and containers for this remote")
+	gnuflag.BoolVar(&c.insecure, "insecure", false, "Allow this image server to be reached over plain http")
+}
 
 func addServer(config *lxd.Config, server string) error {
 	lxd.Debugf("connecting to %s", server)
@@ -98,13 +113,17 @@ func (c *remoteCmd) run(config *lxd.Config, args []string) error {
 		if config.Remotes == nil {
 			config.Remotes = make(map[string]lxd.RemoteConfig)
 		}
-		config.Remotes[args[1]] = lxd.RemoteConfig{Addr: args[2]}
+		config.Remotes[args[1]] = lxd.RemoteConfig{Addr: args[2], AlwaysRelay: c.alwaysRelay, Insecure: c.insecure}
 
-		// todo - we'll need to check whether this is a lxd remote that handles /list/add
-		err := addServer(config, args[1])
-		if err != nil {
-			// todo - remove from config.Remotes since we failed
-			return err
+		/* Image servers don't speak the lxd protocol, so there's
+		 * nothing to authenticate against. */
+		if !lxd.IsImageServer(args[2]) {
+			// todo - we'll need to check whether this is a lxd remote that handles /list/add
+			err := addServer(config, args[1])
+			if err != nil {
+				// todo - remove from config.Remotes since we failed
+				return err
+			}
 		}
 
 	case "remove":
@@ -126,7 +145,14 @@ func (c *remoteCmd) run(config *lxd.Config, args []string) error {
 
 	case "list":
 		for name, rc := range config.Remotes {
-			fmt.Println(fmt.Sprintf("%s <%s>", name, rc.Addr))
+			flags := ""
+			if rc.AlwaysRelay {
+				flags += " (always relay)"
+			}
+			if rc.Insecure {
+				flags += " (insecure)"
+			}
+			fmt.Println(fmt.Sprintf("%s <%s>%s", name, rc.Addr, flags))
 		}
 		/* Here, we don't need to save since we didn't actually modify
 		 * anything, so just return. */
@@ -157,11 +183,12 @@ func (c *remoteCmd) run(config *lxd.Config, args []string) error {
 		if len(args) != 3 {
 			return errArgs
 		}
-		_, ok := config.Remotes[args[1]]
+		rc, ok := config.Remotes[args[1]]
 		if !ok {
 			return fmt.Errorf("remote %s doesn't exist", args[1])
 		}
-		config.Remotes[args[1]] = lxd.RemoteConfig{Addr: args[2]}
+		rc.Addr = args[2]
+		config.Remotes[args[1]] = rc
 
 	case "set-default":
 		if len(args) != 2 {
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/lxc/lxd"
+	"github.com/lxc/lxd/internal/gnuflag"
+)
+
+type restoreCmd struct {
+	stateful bool
+}
+
+const restoreUsage = `
+Restore a container to one of its snapshots.
+
+lxc restore [remote:]<container> <snapshot name> [--stateful]
+
+The container must be stopped, unless --stateful is given and the snapshot
+has the container's running state, in which case the container is killed,
+reset to the snapshot and its running state restored. The snapshot is kept.
+`
+
+func (c *restoreCmd) usage() string {
+	return restoreUsage
+}
+
+func (c *restoreCmd) flags() {
+	gnuflag.BoolVar(&c.stateful, "stateful", false, "Whether or not to restore the container's running state")
+}
+
+func (c *restoreCmd) run(config *lxd.Config, args []string) error {
+	if len(args) != 2 {
+		return errArgs
+	}
+
+	d, name, err := lxd.NewClient(config, args[0])
+	if err != nil {
+		return err
+	}
+
+	resp, err := d.Restore(name, args[1], c.stateful)
+	if err != nil {
+		return err
+	}
+
+	return d.WaitForSuccess(resp.Operation)
+}
@@ -1,18 +1,44 @@
 package main
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/lxc/lxd"
 	"github.com/lxc/lxd/internal/gnuflag"
+	"gopkg.in/yaml.v2"
 )
 
 type snapshotCmd struct {
-	stateful bool
+	stateful    bool
+	description string
+	expiry      string
+	force       bool
 }
 
 const snapshotUsage = `
-Create a read-only snapshot of a container.
+Manage snapshots of containers.
 
-lxc snapshot <source> <snapshot name> [--stateful]
+lxc snapshot [remote:]<container> <snapshot name> [--stateful] [--description=<text>] [--expiry=<duration>]
+    Create a read-only snapshot of a container, with its running state if
+    --stateful is given. With --expiry, e.g. --expiry=72h, the snapshot is
+    deleted automatically once that much time has passed.
+lxc snapshot list [remote:]<container>
+    List a container's snapshots.
+lxc snapshot info [remote:]<container>/<snapshot>
+    Show a snapshot's metadata.
+lxc snapshot rename [remote:]<container>/<snapshot> <new name>
+    Rename a snapshot.
+lxc snapshot protect [remote:]<container>/<snapshot>
+lxc snapshot unprotect [remote:]<container>/<snapshot>
+    Protect a snapshot from being deleted, by hand or when it expires, or
+    lift that protection.
+lxc snapshot expire [remote:]<container>/<snapshot> <duration>
+    Delete a snapshot automatically once duration has passed, or never if
+    duration is 0.
+lxc snapshot delete [remote:]<container>/<snapshot> [--force]
+    Delete a snapshot, even a protected one if --force is given.
 `
 
 func (c *snapshotCmd) usage() string {
@@ -21,10 +47,168 @@ func (c *snapshotCmd) usage() string {
 
 func (c *snapshotCmd) flags() {
 	gnuflag.BoolVar(&c.stateful, "stateful", false, "Whether or not to snapshot the container's running state")
+	gnuflag.StringVar(&c.description, "description", "", "A description of the snapshot")
+	gnuflag.StringVar(&c.expiry, "expiry", "", "How long until the snapshot is deleted automatically")
+	gnuflag.BoolVar(&c.force, "force", false, "Delete the snapshot even if it is protected")
+}
+
+/* The expiry date of a snapshot expiring after duration, 0 meaning never */
+func expiryDate(duration string) (int64, error) {
+	if duration == "" || duration == "0" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(duration)
+	if err != nil {
+		return 0, err
+	}
+
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid expiry %s", duration)
+	}
+
+	return time.Now().Add(d).Unix(), nil
+}
+
+/* Split a [remote:]<container>/<snapshot> reference */
+func snapshotRef(config *lxd.Config, ref string) (*lxd.Client, string, string, error) {
+	d, name, err := lxd.NewClient(config, ref)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	fields := strings.SplitN(name, "/", 2)
+	if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+		return nil, "", "", fmt.Errorf("%s isn't a snapshot, snapshots are given as <container>/<snapshot>", ref)
+	}
+
+	return d, fields[0], fields[1], nil
 }
 
 func (c *snapshotCmd) run(config *lxd.Config, args []string) error {
-	if len(args) < 2 {
+	if len(args) < 1 {
+		return errArgs
+	}
+
+	switch args[0] {
+	case "list":
+		if len(args) != 2 {
+			return errArgs
+		}
+
+		d, name, err := lxd.NewClient(config, args[1])
+		if err != nil {
+			return err
+		}
+
+		snapshots, err := d.ListSnapshots(name)
+		if err != nil {
+			return err
+		}
+
+		for _, snapshot := range snapshots {
+			fmt.Println(snapshotLine(snapshot))
+		}
+		return nil
+
+	case "info":
+		if len(args) != 2 {
+			return errArgs
+		}
+
+		d, name, snapshotName, err := snapshotRef(config, args[1])
+		if err != nil {
+			return err
+		}
+
+		info, err := d.GetSnapshot(name, snapshotName)
+		if err != nil {
+			return err
+		}
+
+		data, err := yaml.Marshal(info)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s", data)
+		return nil
+
+	case "rename":
+		if len(args) != 3 {
+			return errArgs
+		}
+
+		d, name, snapshotName, err := snapshotRef(config, args[1])
+		if err != nil {
+			return err
+		}
+
+		resp, err := d.RenameSnapshot(name, snapshotName, args[2])
+		if err != nil {
+			return err
+		}
+
+		return d.WaitForSuccess(resp.Operation)
+
+	case "protect", "unprotect":
+		if len(args) != 2 {
+			return errArgs
+		}
+
+		d, name, snapshotName, err := snapshotRef(config, args[1])
+		if err != nil {
+			return err
+		}
+
+		info, err := d.GetSnapshot(name, snapshotName)
+		if err != nil {
+			return err
+		}
+
+		return d.UpdateSnapshot(name, snapshotName, args[0] == "protect", info.ExpiryDate)
+
+	case "expire":
+		if len(args) != 3 {
+			return errArgs
+		}
+
+		d, name, snapshotName, err := snapshotRef(config, args[1])
+		if err != nil {
+			return err
+		}
+
+		expiry, err := expiryDate(args[2])
+		if err != nil {
+			return err
+		}
+
+		info, err := d.GetSnapshot(name, snapshotName)
+		if err != nil {
+			return err
+		}
+
+		return d.UpdateSnapshot(name, snapshotName, info.Protected, expiry)
+
+	case "delete":
+		if len(args) != 2 {
+			return errArgs
+		}
+
+		d, name, snapshotName, err := snapshotRef(config, args[1])
+		if err != nil {
+			return err
+		}
+
+		resp, err := d.DeleteSnapshot(name, snapshotName, c.force)
+		if err != nil {
+			return err
+		}
+
+		return d.WaitForSuccess(resp.Operation)
+	}
+
+	if len(args) != 2 {
 		return errArgs
 	}
 
@@ -33,10 +217,58 @@ func (c *snapshotCmd) run(config *lxd.Config, args []string) error {
 		return err
 	}
 
-	resp, err := d.Snapshot(name, args[1], c.stateful)
+	expiry, err := expiryDate(c.expiry)
+	if err != nil {
+		return err
+	}
+
+	resp, err := d.Snapshot(name, args[1], c.stateful, c.description, expiry)
 	if err != nil {
 		return err
 	}
 
 	return d.WaitForSuccess(resp.Operation)
 }
+
+/*
+ * One line about a snapshot, for snapshot lists and lxc list.
+ */
+func snapshotLine(snapshot lxd.SnapshotInfo) string {
+	created := time.Unix(snapshot.CreationDate, 0).UTC().Format("2006/01/02 15:04 UTC")
+
+	state := "stateless"
+	if snapshot.Stateful {
+		state = "stateful"
+	}
+
+	if snapshot.Protected {
+		state += ",protected"
+	}
+
+	line := fmt.Sprintf("%s\t%s\t%s\t%s", snapshot.Name, created, humanSize(snapshot.Size), state)
+	if snapshot.ExpiryDate != 0 {
+		line += "\texpires " + time.Unix(snapshot.ExpiryDate, 0).UTC().Format("2006/01/02 15:04 UTC")
+	}
+	if snapshot.Description != "" {
+		line += "\t" + snapshot.Description
+	}
+
+	return line
+}
+
+func humanSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d%s", size, units[0])
+	}
+
+	return fmt.Sprintf("%.1f%s", value, units[unit])
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/lxc/lxd"
+)
+
+/*
+ * All the image aliases live in a single json file, keyed by name, which
+ * is what keeps them unique. aliasLock protects its read-modify-write
+ * cycles.
+ */
+var aliasLock sync.Mutex
+
+func aliasesPath() string {
+	return lxd.VarPath("images", "aliases.json")
+}
+
+func readAliases() (map[string]lxd.ImageAlias, error) {
+	aliases := map[string]lxd.ImageAlias{}
+
+	buf, err := ioutil.ReadFile(aliasesPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return aliases, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(buf, &aliases); err != nil {
+		return nil, err
+	}
+
+	return aliases, nil
+}
+
+func writeAliases(aliases map[string]lxd.ImageAlias) error {
+	if err := os.MkdirAll(imagesDir(), 0700); err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(aliases)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(aliasesPath(), buf, 0600)
+}
+
+func validAliasName(name string) error {
+	if name == "" || strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") {
+		return fmt.Errorf("invalid alias name '%s'", name)
+	}
+
+	if strings.Contains(name, ":") {
+		return fmt.Errorf("alias names may not contain colons")
+	}
+
+	return nil
+}
+
+/*
+ * Resolve an image reference, which is either an alias or a (possibly
+ * abbreviated) fingerprint, to a fingerprint.
+ */
+func resolveImage(ref string) (string, error) {
+	aliasLock.Lock()
+	aliases, err := readAliases()
+	aliasLock.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	if alias, ok := aliases[ref]; ok {
+		return alias.Target, nil
+	}
+
+	return findImage(ref)
+}
+
+/*
+ * Drop the aliases pointing at an image which is being removed.
+ */
+func removeImageAliases(fingerprint string) error {
+	aliasLock.Lock()
+	defer aliasLock.Unlock()
+
+	aliases, err := readAliases()
+	if err != nil {
+		return err
+	}
+
+	for name, alias := range aliases {
+		if alias.Target == fingerprint {
+			delete(aliases, name)
+		}
+	}
+
+	return writeAliases(aliases)
+}
+
+func aliasesGet(d *Daemon, r *http.Request) Response {
+	aliasLock.Lock()
+	aliases, err := readAliases()
+	aliasLock.Unlock()
+	if err != nil {
+		return InternalError(err)
+	}
+
+	names := make([]string, 0, len(aliases))
+	for name := range aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	body := make([]string, 0, len(names))
+	for _, name := range names {
+		body = append(body, fmt.Sprintf("/%s/images/aliases/%s", lxd.APIVersion, name))
+	}
+
+	return SyncResponse(true, body)
+}
+
+func aliasesPost(d *Daemon, r *http.Request) Response {
+	req := lxd.ImageAlias{}
+	if err := lxd.ReadToJson(r.Body, &req); err != nil {
+		return BadRequest(err)
+	}
+
+	if err := validAliasName(req.Name); err != nil {
+		return BadRequest(err)
+	}
+
+	target, err := findImage(req.Target)
+	if err != nil {
+		return BadRequest(fmt.Errorf("bad alias target: %s", err))
+	}
+	req.Target = target
+
+	aliasLock.Lock()
+	defer aliasLock.Unlock()
+
+	aliases, err := readAliases()
+	if err != nil {
+		return InternalError(err)
+	}
+
+	if _, ok := aliases[req.Name]; ok {
+		return BadRequest(fmt.Errorf("alias %s already exists", req.Name))
+	}
+
+	aliases[req.Name] = req
+	if err := writeAliases(aliases); err != nil {
+		return InternalError(err)
+	}
+
+	return EmptySyncResponse
+}
+
+var aliasesCmd = Command{"images/aliases", false, false, aliasesGet, nil, aliasesPost, nil, nil}
+
+func aliasGet(d *Daemon, r *http.Request) Response {
+	name := mux.Vars(r)["name"]
+
+	aliasLock.Lock()
+	aliases, err := readAliases()
+	aliasLock.Unlock()
+	if err != nil {
+		return InternalError(err)
+	}
+
+	alias, ok := aliases[name]
+	if !ok {
+		return NotFound
+	}
+
+	return SyncResponse(true, alias)
+}
+
+func aliasPut(d *Daemon, r *http.Request) Response {
+	name := mux.Vars(r)["name"]
+
+	req := lxd.ImageAlias{}
+	if err := lxd.ReadToJson(r.Body, &req); err != nil {
+		return BadRequest(err)
+	}
+
+	if req.Name != "" && req.Name != name {
+		return BadRequest(fmt.Errorf("aliases can only be renamed with POST"))
+	}
+	req.Name = name
+
+	target, err := findImage(req.Target)
+	if err != nil {
+		return BadRequest(fmt.Errorf("bad alias target: %s", err))
+	}
+	req.Target = target
+
+	aliasLock.Lock()
+	defer aliasLock.Unlock()
+
+	aliases, err := readAliases()
+	if err != nil {
+		return InternalError(err)
+	}
+
+	if _, ok := aliases[name]; !ok {
+		return NotFound
+	}
+
+	aliases[name] = req
+	if err := writeAliases(aliases); err != nil {
+		return InternalError(err)
+	}
+
+	return EmptySyncResponse
+}
+
+func aliasPost(d *Daemon, r *http.Request) Response {
+	name := mux.Vars(r)["name"]
+
+	raw := lxd.Jmap{}
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		return BadRequest(err)
+	}
+
+	newName, err := raw.GetString("name")
+	if err != nil {
+		return BadRequest(err)
+	}
+
+	if err := validAliasName(newName); err != nil {
+		return BadRequest(err)
+	}
+
+	aliasLock.Lock()
+	defer aliasLock.Unlock()
+
+	aliases, err := readAliases()
+	if err != nil {
+		return InternalError(err)
+	}
+
+	alias, ok := aliases[name]
+	if !ok {
+		return NotFound
+	}
+
+	if _, ok := aliases[newName]; ok {
+		return BadRequest(fmt.Errorf("alias %s already exists", newName))
+	}
+
+	delete(aliases, name)
+	alias.Name = newName
+	aliases[newName] = alias
+
+	if err := writeAliases(aliases); err != nil {
+		return InternalError(err)
+	}
+
+	return EmptySyncResponse
+}
+
+func aliasDelete(d *Daemon, r *http.Request) Response {
+	name := mux.Vars(r)["name"]
+
+	aliasLock.Lock()
+	defer aliasLock.Unlock()
+
+	aliases, err := readAliases()
+	if err != nil {
+		return InternalError(err)
+	}
+
+	if _, ok := aliases[name]; !ok {
+		return NotFound
+	}
+
+	delete(aliases, name)
+	if err := writeAliases(aliases); err != nil {
+		return InternalError(err)
+	}
+
+	return EmptySyncResponse
+}
+
+/* Alias names may contain slashes, e.g. "ubuntu/trusty" */
+var aliasCmd = Command{"images/aliases/{name:.+}", false, false, aliasGet, aliasPut, aliasPost, aliasDelete, nil}
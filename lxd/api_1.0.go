@@ -18,13 +18,24 @@ var api10 = []Command{
 	containerCmd,
 	containerStateCmd,
 	containerFileCmd,
+	containerExportCmd,
+	containerMigrationCmd,
 	containerSnapshotsCmd,
 	containerSnapshotCmd,
+	snapshotExportCmd,
 	operationsCmd,
 	operationCmd,
 	operationWait,
 	networksCmd,
 	networkCmd,
+	profilesCmd,
+	profileCmd,
+	imagesCmd,
+	aliasesCmd,
+	aliasCmd,
+	relayCmd,
+	imageCmd,
+	imageExportCmd,
 	api10Cmd,
 	listCmd,
 	trustCmd,
@@ -153,4 +164,4 @@ func api10Put(d *Daemon, r *http.Request) Response {
 	return EmptySyncResponse
 }
 
-var api10Cmd = Command{"", true, false, api10Get, api10Put, nil, nil}
+var api10Cmd = Command{"", true, false, api10Get, api10Put, nil, nil, nil}
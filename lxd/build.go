@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/lxc/lxd"
+	"gopkg.in/lxc/go-lxc.v2"
+)
+
+/* How long we wait for a build container to start */
+const buildStartTimeout = 30 * time.Second
+
+/* How often a build's log is shared while it runs, and how much of its end */
+const buildLogInterval = time.Second
+const buildLogTail = 16 * 1024
+
+/*
+ * The output of a build. Its end is shared with the operation's metadata
+ * as it grows, now and then, so that chatty builds don't have all of it
+ * encoded again on every write. The whole log is shared once it's done.
+ */
+type buildLog struct {
+	lock    sync.Mutex
+	buf     bytes.Buffer
+	op      string
+	updated time.Time
+}
+
+func (l *buildLog) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	n, err := l.buf.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	if time.Since(l.updated) < buildLogInterval {
+		return n, nil
+	}
+	l.updated = time.Now()
+
+	tail := l.buf.Bytes()
+	if len(tail) > buildLogTail {
+		tail = tail[len(tail)-buildLogTail:]
+	}
+
+	return n, UpdateOperationMetadata(l.op, lxd.Jmap{"log": string(tail)})
+}
+
+func (l *buildLog) Printf(format string, args ...interface{}) {
+	fmt.Fprintf(l, format+"\n", args...)
+}
+
+func (l *buildLog) String() string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.buf.String()
+}
+
+/*
+ * Run a shell command in a running container, with its output going to the
+ * log.
+ */
+func runCommand(c *lxc.Container, command string, log io.Writer) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan bool)
+	go func() {
+		io.Copy(log, r)
+		r.Close()
+		done <- true
+	}()
+
+	options := lxc.DefaultAttachOptions
+	options.ClearEnv = true
+	options.Env = []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"}
+	options.StdoutFd = w.Fd()
+	options.StderrFd = w.Fd()
+
+	status, err := c.RunCommandStatus([]string{"/bin/sh", "-c", command}, options)
+	w.Close()
+	<-done
+	if err != nil {
+		return err
+	}
+
+	if status != 0 {
+		return fmt.Errorf("'%s' failed with exit status %d", command, status)
+	}
+
+	return nil
+}
+
+/*
+ * Get rid of a build container, however far creating it got.
+ */
+func destroyBuildContainer(d *Daemon, c *lxc.Container) {
+	if c.Running() {
+		c.Stop()
+	}
+
+	if c.Defined() {
+		if err := c.Destroy(); err == nil {
+			return
+		}
+	}
+
+	os.RemoveAll(path.Join(d.lxcpath, c.Name()))
+}
+
+/*
+ * Build an image from a recipe: create a throwaway container from the base
+ * image, push the files into it and run the commands, then publish it. The
+ * container is removed whether the build succeeds or not, and the build log
+ * is kept in the operation's metadata.
+ */
+func imagesBuild(d *Daemon, req *imagesPublishReq) Response {
+	recipe := lxd.ImageRecipe{}
+
+	buf, err := json.Marshal(req.Source)
+	if err != nil {
+		return InternalError(err)
+	}
+
+	if err := json.Unmarshal(buf, &recipe); err != nil {
+		return BadRequest(err)
+	}
+
+	modes := make([]os.FileMode, len(recipe.Files))
+	for i, file := range recipe.Files {
+		if file.Path == "" {
+			return BadRequest(fmt.Errorf("recipe files need a path"))
+		}
+
+		modes[i] = 0644
+		if file.Mode != "" {
+			mode, err := strconv.ParseUint(file.Mode, 8, 32)
+			if err != nil {
+				return BadRequest(fmt.Errorf("bad mode %s for %s", file.Mode, file.Path))
+			}
+			modes[i] = os.FileMode(mode)
+		}
+	}
+
+	name := "build-" + strings.Replace(uuid.New(), "-", "", -1)[:12]
+	source := lxd.Jmap{"type": "image", "fingerprint": recipe.Base}
+	create, resp := createContainer(d, lxd.Jmap{"name": name, "source": source})
+	if resp != nil {
+		return resp
+	}
+
+	c, err := lxc.NewContainer(name, d.lxcpath)
+	if err != nil {
+		return InternalError(err)
+	}
+
+	build := func(id string) error {
+		log := &buildLog{op: id}
+
+		fingerprint, err := func() (string, error) {
+			log.Printf("creating %s from %s", name, recipe.Base)
+			defer destroyBuildContainer(d, c)
+			if err := create(); err != nil {
+				return "", err
+			}
+
+			if err := startContainer(c); err != nil {
+				return "", err
+			}
+
+			if !c.Wait(lxc.RUNNING, buildStartTimeout) {
+				return "", fmt.Errorf("%s didn't start", name)
+			}
+
+			for i, file := range recipe.Files {
+				log.Printf("pushing %s", file.Path)
+				p, err := containerFilePath(c, file.Path)
+				if err != nil {
+					return "", err
+				}
+
+				uid := int(d.id_map.Uidmin) + file.UID
+				gid := int(d.id_map.Gidmin) + file.GID
+				if err := pushFile(p, uid, gid, modes[i], bytes.NewReader(file.Content)); err != nil {
+					return "", err
+				}
+			}
+
+			for _, command := range recipe.Commands {
+				log.Printf("running %s", command)
+				if err := runCommand(c, command, log); err != nil {
+					return "", err
+				}
+			}
+
+			log.Printf("publishing %s", name)
+			if err := c.Stop(); err != nil {
+				return "", err
+			}
+
+			meta, err := containerImageMetadata(c, req.Properties)
+			if err != nil {
+				return "", err
+			}
+
+			return writeImage(d, c.ConfigItem("lxc.rootfs")[0], meta, req.Public)
+		}()
+		if err != nil {
+			log.Printf("build failed: %s", err)
+			return err
+		}
+
+		return UpdateOperationMetadata(id, lxd.Jmap{"fingerprint": fingerprint, "log": log.String()})
+	}
+
+	return AsyncResponseWithProgress(build, nil, nil)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lxc/lxd"
+	"gopkg.in/lxc/go-lxc.v2"
+)
+
+/*
+ * The lxd specific configuration of a container, stored alongside the lxc
+ * config in the container's directory.
+ */
+type containerConfig struct {
+	Profiles []string   `json:"profiles"`
+	Config   []lxd.Jmap `json:"config"`
+}
+
+func containerConfigPath(name string) string {
+	return lxd.VarPath("lxc", name, "lxd.json")
+}
+
+func readContainerConfig(name string) (*containerConfig, error) {
+	cc := containerConfig{Profiles: []string{}, Config: []lxd.Jmap{}}
+
+	buf, err := ioutil.ReadFile(containerConfigPath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &cc, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(buf, &cc); err != nil {
+		return nil, err
+	}
+
+	return &cc, nil
+}
+
+func writeContainerConfig(name string, cc *containerConfig) error {
+	buf, err := json.Marshal(cc)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(containerConfigPath(name), buf, 0600)
+}
+
+var networkKey = regexp.MustCompile(`^network\.([0-9]+)\.([a-z]+)$`)
+var hwaddrKey = regexp.MustCompile(`^(lxc\.)?network\.[0-9]+\.hwaddr$`)
+
+/*
+ * Keys which lxd acts upon itself rather than passing them on to lxc, along
+ * with what checks their values.
+ */
+var lxdConfigKeys = map[string]func(string) error{
+	"snapshots.schedule":  validDuration,
+	"snapshots.retention": validCount,
+	"snapshots.max_age":   validDuration,
+}
+
+func validDuration(value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+
+	if d <= 0 {
+		return fmt.Errorf("%s isn't a positive duration", value)
+	}
+
+	return nil
+}
+
+func validCount(value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+
+	if n < 0 {
+		return fmt.Errorf("%s is negative", value)
+	}
+
+	return nil
+}
+
+/*
+ * Translate a lxd config key into the lxc config key it stands for. Raw lxc
+ * keys are passed through untouched.
+ */
+func lxcConfigKey(key string) (string, error) {
+	if strings.HasPrefix(key, "lxc.") {
+		return key, nil
+	}
+
+	switch key {
+	case "resources.memory":
+		return "lxc.cgroup.memory.limit_in_bytes", nil
+	case "resources.cpus":
+		return "lxc.cgroup.cpuset.cpus", nil
+	case "resources.cpu_shares":
+		return "lxc.cgroup.cpu.shares", nil
+	}
+
+	if m := networkKey.FindStringSubmatch(key); m != nil {
+		switch m[2] {
+		case "bridge":
+			return fmt.Sprintf("lxc.network.%s.link", m[1]), nil
+		case "type", "name", "hwaddr", "mtu", "flags":
+			return fmt.Sprintf("lxc.network.%s.%s", m[1], m[2]), nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown config key %s", key)
+}
+
+/*
+ * lxc wants sizes like "2G", but users tend to write "2GB".
+ */
+func lxcConfigValue(key string, value string) string {
+	if key == "resources.memory" {
+		for _, unit := range []string{"KB", "MB", "GB", "TB"} {
+			if strings.HasSuffix(value, unit) {
+				return strings.TrimSuffix(value, "B")
+			}
+		}
+	}
+
+	return value
+}
+
+/*
+ * A container's config as its copies get it: without the MAC addresses it
+ * sets, so that copies get fresh ones rather than clash with the original.
+ */
+func copyConfig(config []lxd.Jmap) []lxd.Jmap {
+	copied := []lxd.Jmap{}
+	for _, item := range config {
+		if key, err := item.GetString("key"); err == nil && hwaddrKey.MatchString(key) {
+			continue
+		}
+		copied = append(copied, item)
+	}
+
+	return copied
+}
+
+func configItem(item lxd.Jmap) (string, string, error) {
+	key, err := item.GetString("key")
+	if err != nil {
+		return "", "", err
+	}
+
+	value, err := item.GetString("value")
+	if err != nil {
+		return "", "", err
+	}
+
+	return key, value, nil
+}
+
+/*
+ * Convert a config list freshly decoded into an interface{} into a list of
+ * config items.
+ */
+func parseConfig(raw interface{}) ([]lxd.Jmap, error) {
+	list, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("config was not a list, got %T", raw)
+	}
+
+	config := make([]lxd.Jmap, 0, len(list))
+	for _, elt := range list {
+		item, ok := elt.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("config item was not a map, got %T", elt)
+		}
+		config = append(config, item)
+	}
+
+	return config, validConfig(config)
+}
+
+func validConfig(config []lxd.Jmap) error {
+	for _, item := range config {
+		key, value, err := configItem(item)
+		if err != nil {
+			return err
+		}
+
+		if check, ok := lxdConfigKeys[key]; ok {
+			if err := check(value); err != nil {
+				return fmt.Errorf("bad value for %s: %s", key, err)
+			}
+			continue
+		}
+
+		if _, err := lxcConfigKey(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func setConfig(c *lxc.Container, config []lxd.Jmap) error {
+	for _, item := range config {
+		key, value, err := configItem(item)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := lxdConfigKeys[key]; ok {
+			continue
+		}
+
+		lxcKey, err := lxcConfigKey(key)
+		if err != nil {
+			return err
+		}
+
+		lxd.Debugf("setting %s to %s on %s", lxcKey, value, c.Name())
+		if err := c.SetConfigItem(lxcKey, lxcConfigValue(key, value)); err != nil {
+			return fmt.Errorf("failed setting %s: %s", key, err)
+		}
+	}
+
+	return nil
+}
+
+/*
+ * Apply the container's profiles, in order, to its in-memory lxc config,
+ * followed by the container's own config which overrides them.
+ */
+func applyConfig(c *lxc.Container, cc *containerConfig) error {
+	for _, name := range cc.Profiles {
+		p, err := readProfile(name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("profile %s doesn't exist", name)
+			}
+			return err
+		}
+
+		if err := setConfig(c, p.Config); err != nil {
+			return err
+		}
+	}
+
+	return setConfig(c, cc.Config)
+}
+
+/*
+ * Reload the container's lxc config file and apply its lxd config on top of
+ * it, in memory only. The file is left with just the base config, so that
+ * keys removed from a profile or the container go away, and multi-valued
+ * ones like lxc.id_map aren't appended again each time.
+ */
+func loadConfig(c *lxc.Container) error {
+	cc, err := readContainerConfig(c.Name())
+	if err != nil {
+		return err
+	}
+
+	c.ClearConfig()
+	if err := c.LoadConfigFile(c.ConfigFileName()); err != nil {
+		return err
+	}
+
+	return applyConfig(c, cc)
+}
+
+/*
+ * The values of the lxd specific keys of a container, with its own config
+ * overriding that of its profiles like in applyConfig.
+ */
+func lxdConfig(cc *containerConfig) (map[string]string, error) {
+	config := map[string]string{}
+
+	items := []lxd.Jmap{}
+	for _, name := range cc.Profiles {
+		p, err := readProfile(name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		items = append(items, p.Config...)
+	}
+	items = append(items, cc.Config...)
+
+	for _, item := range items {
+		key, value, err := configItem(item)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := lxdConfigKeys[key]; ok {
+			config[key] = value
+		}
+	}
+
+	return config, nil
+}
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
 	"strconv"
@@ -22,128 +23,766 @@ import (
 func containersPost(d *Daemon, r *http.Request) Response {
 	lxd.Debugf("responding to create")
 
-	if d.id_map == nil {
-		return BadRequest(fmt.Errorf("lxd's user has no subuids"))
-	}
-
 	raw := lxd.Jmap{}
 	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
 		return BadRequest(err)
 	}
 
+	create, resp := createContainer(d, raw)
+	if resp != nil {
+		return resp
+	}
+
+	return AsyncResponse(create, nil)
+}
+
+/*
+ * Check a container creation request and return the function which actually
+ * creates the container, or the response to fail the request with.
+ */
+func createContainer(d *Daemon, raw lxd.Jmap) (func() error, Response) {
+	if d.id_map == nil {
+		return nil, BadRequest(fmt.Errorf("lxd's user has no subuids"))
+	}
+
 	name, err := raw.GetString("name")
 	if err != nil {
 		/* TODO: namegen code here */
 		name = "foo"
 	}
 
+	profiles, err := raw.GetStringList("profiles")
+	if err != nil {
+		if _, ok := raw["profiles"]; ok {
+			return nil, BadRequest(err)
+		}
+		profiles = []string{"default"}
+	}
+
+	for _, p := range profiles {
+		if _, err := readProfile(p); err != nil {
+			return nil, BadRequest(fmt.Errorf("bad profile %s: %s", p, err))
+		}
+	}
+
+	config := []lxd.Jmap{}
+	if rawConfig, ok := raw["config"]; ok {
+		config, err = parseConfig(rawConfig)
+		if err != nil {
+			return nil, BadRequest(err)
+		}
+	}
+
 	source, err := raw.GetMap("source")
 	if err != nil {
-		return BadRequest(err)
+		return nil, BadRequest(err)
 	}
 
 	type_, err := source.GetString("type")
 	if err != nil {
-		return BadRequest(err)
+		return nil, BadRequest(err)
 	}
 
-	url, err := source.GetString("url")
+	c, err := lxc.NewContainer(name, d.lxcpath)
 	if err != nil {
-		return BadRequest(err)
+		return nil, InternalError(err)
+	}
+
+	/*
+	 * build creates the container's directory and lxc config. done, if
+	 * set, is told whether creating the container worked in the end.
+	 */
+	var build func() error
+	var done func(err error) error
+	switch type_ {
+	case "remote":
+		url, err := source.GetString("url")
+		if err != nil {
+			return nil, BadRequest(err)
+		}
+
+		imageName, err := source.GetString("name")
+		if err != nil {
+			return nil, BadRequest(err)
+		}
+
+		variant, err := source.GetString("variant")
+		if err != nil {
+			variant = ""
+		}
+
+		/* Only set for image servers the user marked insecure */
+		insecure, err := source.GetBool("insecure")
+		if err != nil {
+			insecure = false
+		}
+
+		opts, err := downloadOptions(url, imageName, variant, insecure)
+		if err != nil {
+			return nil, BadRequest(err)
+		}
+
+		cacheSource := imageCacheSource(url, opts)
+		fingerprint, err := findCachedImage(cacheSource, insecure)
+		if err != nil {
+			return nil, InternalError(err)
+		}
+
+		/* Relayed images were put in the image store by the client. */
+		if relay, err := source.GetBool("relay"); err == nil && relay && fingerprint == "" {
+			return nil, BadRequest(fmt.Errorf("no relayed image for %s", cacheSource))
+		}
+
+		if fingerprint != "" {
+			lxd.Debugf("using cached image %s for %s", fingerprint, cacheSource)
+		}
+
+		if err := loadDefaultConfig(c); err != nil {
+			return nil, InternalError(err)
+		}
+
+		build = func() error {
+			if fingerprint == "" {
+				var err error
+				fingerprint, err = fetchImage(d, url, opts, insecure)
+				if err != nil {
+					return err
+				}
+			}
+
+			/*
+			 * Images from image servers carry the distro's lxc
+			 * config along, which the container's own overrides.
+			 */
+			meta, err := readImageMetadata(imagePath(fingerprint))
+			if err != nil {
+				return err
+			}
+			config = append(meta.Config, config...)
+
+			return createFromImage(d, c, fingerprint)
+		}
+	case "image":
+		ref, err := source.GetString("fingerprint")
+		if err != nil {
+			ref, err = source.GetString("alias")
+			if err != nil {
+				return nil, BadRequest(fmt.Errorf("image source needs a fingerprint or an alias"))
+			}
+		}
+
+		fingerprint, err := resolveImage(ref)
+		if err != nil {
+			return nil, BadRequest(fmt.Errorf("bad image %s: %s", ref, err))
+		}
+
+		/* Published images carry their container's config along. */
+		meta, err := readImageMetadata(imagePath(fingerprint))
+		if err != nil {
+			return nil, InternalError(err)
+		}
+
+		if err := validConfig(meta.Config); err != nil {
+			return nil, BadRequest(fmt.Errorf("bad image config: %s", err))
+		}
+		config = append(meta.Config, config...)
+
+		if err := loadDefaultConfig(c); err != nil {
+			return nil, InternalError(err)
+		}
+
+		build = func() error { return createFromImage(d, c, fingerprint) }
+	case "copy":
+		sourceName, err := source.GetString("source")
+		if err != nil {
+			return nil, BadRequest(err)
+		}
+
+		fields := strings.SplitN(sourceName, "/", 2)
+		sc, err := lxc.NewContainer(fields[0], d.lxcpath)
+		if err != nil {
+			return nil, InternalError(err)
+		}
+
+		if !sc.Defined() {
+			return nil, BadRequest(fmt.Errorf("container %s doesn't exist", fields[0]))
+		}
+
+		/*
+		 * Copies get the source's profiles and config, less its MAC
+		 * addresses, unless told otherwise.
+		 */
+		cc, err := readContainerConfig(fields[0])
+		if err != nil {
+			return nil, InternalError(err)
+		}
+
+		if _, ok := raw["profiles"]; !ok {
+			profiles = cc.Profiles
+		}
+
+		if _, ok := raw["config"]; !ok {
+			config = copyConfig(cc.Config)
+		}
+
+		var rootfs string
+		from := sc
+		if len(fields) == 2 {
+			if err := validSnapshotName(fields[1]); err != nil {
+				return nil, BadRequest(err)
+			}
+
+			rootfs = snapshotRootfsDir(sc, fields[1])
+			if _, err := os.Stat(rootfs); err != nil {
+				if os.IsNotExist(err) {
+					return nil, BadRequest(fmt.Errorf("snapshot %s doesn't exist", sourceName))
+				}
+				return nil, InternalError(err)
+			}
+
+			from, err = lxc.NewContainer(fields[1], snapshotsDir(sc))
+			if err != nil {
+				return nil, InternalError(err)
+			}
+		} else {
+			if sc.State() != lxc.STOPPED {
+				return nil, BadRequest(fmt.Errorf("container %s must be stopped to be copied", sc.Name()))
+			}
+			rootfs = sc.ConfigItem("lxc.rootfs")[0]
+		}
+
+		includes, err := lxcIncludes(from)
+		if err != nil {
+			return nil, InternalError(err)
+		}
+
+		if err := loadDefaultConfig(c); err != nil {
+			return nil, InternalError(err)
+		}
+
+		build = func() error { return createFromRootfs(d, c, rootfs, includes) }
+	case "migration":
+		if c.Defined() {
+			return nil, BadRequest(fmt.Errorf("container %s already exists", name))
+		}
+
+		sink, err := newMigrationSink(d, source)
+		if err != nil {
+			return nil, BadRequest(err)
+		}
+
+		if sink.relay {
+			if err := sink.expect(name); err != nil {
+				return nil, BadRequest(err)
+			}
+		}
+
+		if sink.copy {
+			config = copyConfig(config)
+		}
+
+		build = func() error { return sink.receive(d, c) }
+		done = func(err error) error { return sink.finish(d, c, err) }
+	default:
+		/* TODO: support other options here */
+		return nil, NotImplemented
 	}
 
-	imageName, err := source.GetString("name")
+	if err := setIdmap(c, d.id_map); err != nil {
+		if done != nil {
+			done(err)
+		}
+		return nil, InternalError(err)
+	}
+
+	/*
+	 * Actually create the container. Its lxc config file only gets the
+	 * base config; profiles and the container's own config are applied
+	 * on top of it when it's started, here only to check that they can be.
+	 */
+	create := func() error {
+		err := func() error {
+			if err := build(); err != nil {
+				return err
+			}
+
+			cc := &containerConfig{Profiles: profiles, Config: config}
+			if err := writeContainerConfig(name, cc); err != nil {
+				return err
+			}
+
+			if err := c.SaveConfigFile(c.ConfigFileName()); err != nil {
+				return err
+			}
+
+			return loadConfig(c)
+		}()
+
+		if done != nil {
+			if doneErr := done(err); doneErr != nil && err == nil {
+				return doneErr
+			}
+		}
+
+		return err
+	}
+
+	return create, nil
+}
+
+/*
+ * Set the id mapping. This may not be how we want to do it, but it's a
+ * start.  First, we remove any id_map lines in the config which might
+ * have come from ~/.config/lxc/default.conf.  Then add id mapping based
+ * on Domain.id_map
+ */
+func setIdmap(c *lxc.Container, idmap *Idmap) error {
+	if idmap == nil {
+		return nil
+	}
+
+	lxd.Debugf("setting custom idmap")
+	err := c.SetConfigItem("lxc.id_map", "")
 	if err != nil {
-		return BadRequest(err)
+		lxd.Debugf("Failed to clear id mapping, continuing")
+	}
+	uidstr := fmt.Sprintf("u 0 %d %d\n", idmap.Uidmin, idmap.Uidrange)
+	lxd.Debugf("uidstr is %s\n", uidstr)
+	err = c.SetConfigItem("lxc.id_map", uidstr)
+	if err != nil {
+		return err
+	}
+	gidstr := fmt.Sprintf("g 0 %d %d\n", idmap.Gidmin, idmap.Gidrange)
+	return c.SetConfigItem("lxc.id_map", gidstr)
+}
+
+/*
+ * The idmap a container was set up with, nil if it has none.
+ */
+func containerIdmap(c *lxc.Container) (*Idmap, error) {
+	items := c.ConfigItem("lxc.id_map")
+	if len(items) == 0 || items[0] == "" {
+		return nil, nil
+	}
+
+	m := &Idmap{}
+	for _, item := range items {
+		fields := strings.Fields(item)
+		if len(fields) != 4 || fields[1] != "0" {
+			return nil, fmt.Errorf("unsupported id map '%s'", item)
+		}
+
+		min, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil, err
+		}
+
+		idrange, err := strconv.ParseUint(fields[3], 10, 32)
+		if err != nil {
+			return nil, err
+		}
+
+		switch fields[0] {
+		case "u":
+			m.Uidmin, m.Uidrange = uint(min), uint(idrange)
+		case "g":
+			m.Gidmin, m.Gidrange = uint(min), uint(idrange)
+		default:
+			return nil, fmt.Errorf("unsupported id map '%s'", item)
+		}
+	}
+
+	return m, nil
+}
+
+/*
+ * Move a container, and its snapshots, over to our idmap if it was set up
+ * with another one, e.g. because our allocation in /etc/subuid changed.
+ * Snapshots go first, so that the container's config, saved last, still
+ * tells its old idmap if we don't get to the end.
+ */
+func remapContainer(d *Daemon, c *lxc.Container) error {
+	old, err := containerIdmap(c)
+	if err != nil || old == nil {
+		return err
 	}
 
-	/* TODO: support other options here */
-	if type_ != "remote" {
-		return NotImplemented
+	if *old == *d.id_map {
+		/* Left over if we were interrupted right after remapping it */
+		return os.RemoveAll(c.ConfigItem("lxc.rootfs")[0] + ".old")
 	}
 
-	if url != "https+lxc-images://images.linuxcontainers.org" {
-		return NotImplemented
+	if old.Uidrange > d.id_map.Uidrange || old.Gidrange > d.id_map.Gidrange {
+		return fmt.Errorf("our idmap is smaller than the one %s was set up with", c.Name())
+	}
+
+	if c.State() != lxc.STOPPED {
+		return fmt.Errorf("container %s must be stopped to be remapped", c.Name())
+	}
+
+	lxd.Logf("remapping %s to the current idmap", c.Name())
+
+	snapshots, err := ioutil.ReadDir(snapshotsDir(c))
+	if err != nil && !os.IsNotExist(err) {
+		return err
 	}
 
-	if imageName != "lxc-images/ubuntu/trusty/amd64" {
-		return NotImplemented
+	for _, snapshot := range snapshots {
+		if !snapshot.IsDir() {
+			continue
+		}
+
+		sc, err := lxc.NewContainer(snapshot.Name(), snapshotsDir(c))
+		if err != nil {
+			return err
+		}
+
+		rootfs := snapshotRootfsDir(c, snapshot.Name())
+
+		/* Already remapped, if we were interrupted before */
+		m, err := containerIdmap(sc)
+		if err != nil {
+			return err
+		}
+
+		if m == nil || *m != *old {
+			if err := os.RemoveAll(rootfs + ".old"); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := remapRootfs(d, sc, rootfs, old); err != nil {
+			return err
+		}
 	}
 
-	opts := lxc.TemplateOptions{
-		Template: "download",
-		Distro:   "ubuntu",
-		Release:  "trusty",
-		Arch:     "amd64",
+	return remapRootfs(d, c, c.ConfigItem("lxc.rootfs")[0], old)
+}
+
+/*
+ * Shift a copy of a container's or snapshot's rootfs and swap it in, so that
+ * being interrupted never leaves the rootfs half shifted, then record the new
+ * idmap in its config. The old rootfs is only removed once the config is
+ * saved: if it's still there, the rootfs was already swapped and only the
+ * config is left to do.
+ */
+func remapRootfs(d *Daemon, c *lxc.Container, rootfs string, old *Idmap) error {
+	shifting := rootfs + ".remap"
+	unshifted := rootfs + ".old"
+
+	if _, err := os.Stat(unshifted); err == nil {
+		/* Interrupted between the two renames */
+		if _, err := os.Stat(rootfs); os.IsNotExist(err) {
+			if err := os.Rename(shifting, rootfs); err != nil {
+				return err
+			}
+		}
+	} else {
+		if err := os.RemoveAll(shifting); err != nil {
+			return err
+		}
+
+		output, err := exec.Command("cp", "-a", rootfs, shifting).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed copying rootfs: %s: %s", err, strings.TrimSpace(string(output)))
+		}
+
+		if err := d.id_map.ShiftRootfsFrom(shifting, old); err != nil {
+			os.RemoveAll(shifting)
+			return err
+		}
+
+		if err := os.Rename(rootfs, unshifted); err != nil {
+			return err
+		}
+
+		if err := os.Rename(shifting, rootfs); err != nil {
+			return err
+		}
 	}
 
+	if err := setIdmap(c, d.id_map); err != nil {
+		return err
+	}
+
+	if err := c.SaveConfigFile(c.ConfigFileName()); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(unshifted)
+}
+
+/*
+ * Copy the rootfs of a container or snapshot into the new container's
+ * directory. Like containers created from images, copies start from a fresh
+ * lxc config, so they get their own hostname and MAC addresses.
+ */
+func createFromRootfs(d *Daemon, c *lxc.Container, rootfs string, includes []string) error {
+	dir := path.Join(d.lxcpath, c.Name())
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("container %s already exists", c.Name())
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	err := func() error {
+		for _, include := range includes {
+			if err := c.SetConfigItem("lxc.include", include); err != nil {
+				return err
+			}
+		}
+
+		target := path.Join(dir, "rootfs")
+		output, err := exec.Command("cp", "-a", rootfs, target).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed copying rootfs: %s: %s", err, strings.TrimSpace(string(output)))
+		}
+
+		if err := c.SetConfigItem("lxc.rootfs", target); err != nil {
+			return err
+		}
+
+		return c.SetConfigItem("lxc.utsname", c.Name())
+	}()
+
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	return nil
+}
+
+var containersCmd = Command{"containers", false, false, nil, nil, containersPost, nil, nil}
+
+func containerGet(d *Daemon, r *http.Request) Response {
+	name := mux.Vars(r)["name"]
 	c, err := lxc.NewContainer(name, d.lxcpath)
 	if err != nil {
 		return InternalError(err)
 	}
 
-	/*
-	 * Set the id mapping. This may not be how we want to do it, but it's a
-	 * start.  First, we remove any id_map lines in the config which might
-	 * have come from ~/.config/lxc/default.conf.  Then add id mapping based
-	 * on Domain.id_map
-	 */
-	if d.id_map != nil {
-		lxd.Debugf("setting custom idmap")
-		err = c.SetConfigItem("lxc.id_map", "")
-		if err != nil {
-			lxd.Debugf("Failed to clear id mapping, continuing")
+	if !c.Defined() {
+		return NotFound
+	}
+
+	cc, err := readContainerConfig(name)
+	if err != nil {
+		return InternalError(err)
+	}
+
+	body := lxd.CtoD(c)
+	body.Profiles = cc.Profiles
+	body.Config = cc.Config
+
+	return SyncResponse(true, body)
+}
+
+type containerPutReq struct {
+	Name     string     `json:"name"`
+	Profiles []string   `json:"profiles"`
+	Config   []lxd.Jmap `json:"config"`
+}
+
+/*
+ * Replace the container's profiles and config. The new values are applied
+ * the next time the container starts.
+ */
+func containerPut(d *Daemon, r *http.Request) Response {
+	name := mux.Vars(r)["name"]
+	c, err := lxc.NewContainer(name, d.lxcpath)
+	if err != nil {
+		return InternalError(err)
+	}
+
+	if !c.Defined() {
+		return NotFound
+	}
+
+	req := containerPutReq{}
+	if err := lxd.ReadToJson(r.Body, &req); err != nil {
+		return BadRequest(err)
+	}
+
+	if req.Name != "" && req.Name != name {
+		return BadRequest(fmt.Errorf("containers can only be renamed with POST"))
+	}
+
+	cc := containerConfig{Profiles: req.Profiles, Config: req.Config}
+	if cc.Profiles == nil {
+		cc.Profiles = []string{}
+	}
+	if cc.Config == nil {
+		cc.Config = []lxd.Jmap{}
+	}
+
+	for _, p := range cc.Profiles {
+		if _, err := readProfile(p); err != nil {
+			return BadRequest(fmt.Errorf("bad profile %s: %s", p, err))
 		}
-		uidstr := fmt.Sprintf("u 0 %d %d\n", d.id_map.Uidmin, d.id_map.Uidrange)
-		lxd.Debugf("uidstr is %s\n", uidstr)
-		err = c.SetConfigItem("lxc.id_map", uidstr)
+	}
+
+	if err := validConfig(cc.Config); err != nil {
+		return BadRequest(err)
+	}
+
+	return AsyncResponse(func() error { return writeContainerConfig(name, &cc) }, nil)
+}
+
+func containerDelete(d *Daemon, r *http.Request) Response {
+	name := mux.Vars(r)["name"]
+	c, err := lxc.NewContainer(name, d.lxcpath)
+	if err != nil {
+		return InternalError(err)
+	}
+
+	if !c.Defined() {
+		return NotFound
+	}
+
+	if !forced(r) {
+		protected, err := protectedSnapshots(c)
 		if err != nil {
 			return InternalError(err)
 		}
-		gidstr := fmt.Sprintf("g 0 %d %d\n", d.id_map.Gidmin, d.id_map.Gidrange)
-		err = c.SetConfigItem("lxc.id_map", gidstr)
-		if err != nil {
-			return InternalError(err)
+
+		if len(protected) > 0 {
+			return BadRequest(fmt.Errorf("container %s has protected snapshots: %s", name, strings.Join(protected, ", ")))
 		}
 	}
 
-	/*
-	 * Actually create the container
-	 */
-	return AsyncResponse(func() error { return c.Create(opts) }, nil)
+	return AsyncResponse(c.Destroy, nil)
+}
+
+/*
+ * Whether a DELETE request has "force" set, which overrides snapshot
+ * protection. The body is optional.
+ */
+func forced(r *http.Request) bool {
+	raw := lxd.Jmap{}
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		return false
+	}
+
+	force, err := raw.GetBool("force")
+	return err == nil && force
 }
 
-var containersCmd = Command{"containers", false, false, nil, nil, containersPost, nil}
+/*
+ * Point the paths in an lxc config file which are under oldDir to newDir
+ * instead.
+ */
+func rewriteConfigPaths(file string, oldDir string, newDir string) error {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
 
-func containerGet(d *Daemon, r *http.Request) Response {
+	config := strings.Replace(string(buf), oldDir+"/", newDir+"/", -1)
+	return ioutil.WriteFile(file, []byte(config), 0640)
+}
+
+/*
+ * Rename a stopped container. Its lxc config, lxd config and snapshots all
+ * live in its directory, so moving that and fixing up the paths in the
+ * config files of the container and its snapshots is all it takes.
+ * Requests with "migration" set get the container ready to be moved to
+ * another daemon instead, or copied there if "copy" is set too, see
+ * containerMigrate and containerMigrateCopy.
+ */
+func containerPost(d *Daemon, r *http.Request) Response {
 	name := mux.Vars(r)["name"]
 	c, err := lxc.NewContainer(name, d.lxcpath)
 	if err != nil {
-		return InternalError(err)
+		return InternalError(err)
+	}
+
+	if !c.Defined() {
+		return NotFound
+	}
+
+	raw := lxd.Jmap{}
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		return BadRequest(err)
+	}
+
+	if migration, err := raw.GetBool("migration"); err == nil && migration {
+		if copying, err := raw.GetBool("copy"); err == nil && copying {
+			snapshots, _ := raw.GetBool("snapshots")
+			return containerMigrateCopy(d, c, "", snapshots)
+		}
+
+		return containerMigrate(d, c)
+	}
+
+	newName, err := raw.GetString("name")
+	if err != nil {
+		return BadRequest(err)
 	}
 
-	if !c.Defined() {
-		return NotFound
+	if newName == "" || strings.Contains(newName, "/") {
+		return BadRequest(fmt.Errorf("bad container name '%s'", newName))
 	}
 
-	return SyncResponse(true, lxd.CtoD(c))
-}
+	if c.State() != lxc.STOPPED {
+		return BadRequest(fmt.Errorf("container %s must be stopped to be renamed", name))
+	}
 
-func containerDelete(d *Daemon, r *http.Request) Response {
-	name := mux.Vars(r)["name"]
-	c, err := lxc.NewContainer(name, d.lxcpath)
-	if err != nil {
+	oldDir := path.Join(d.lxcpath, name)
+	newDir := path.Join(d.lxcpath, newName)
+	if _, err := os.Stat(newDir); err == nil {
+		return BadRequest(fmt.Errorf("container %s already exists", newName))
+	} else if !os.IsNotExist(err) {
 		return InternalError(err)
 	}
 
-	if !c.Defined() {
-		return NotFound
+	rename := func() error {
+		if err := os.Rename(oldDir, newDir); err != nil {
+			return err
+		}
+
+		files := []string{path.Join(newDir, "config")}
+		snapshots, err := ioutil.ReadDir(path.Join(newDir, "snapshots"))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		for _, snapshot := range snapshots {
+			if snapshot.IsDir() {
+				files = append(files, path.Join(newDir, "snapshots", snapshot.Name(), "config"))
+			}
+		}
+
+		for _, file := range files {
+			if err := rewriteConfigPaths(file, oldDir, newDir); err != nil {
+				return err
+			}
+		}
+
+		newc, err := lxc.NewContainer(newName, d.lxcpath)
+		if err != nil {
+			return err
+		}
+
+		hostname := newc.ConfigItem("lxc.utsname")
+		if len(hostname) == 0 || hostname[0] != name {
+			return nil
+		}
+
+		if err := newc.SetConfigItem("lxc.utsname", newName); err != nil {
+			return err
+		}
+
+		return newc.SaveConfigFile(newc.ConfigFileName())
 	}
 
-	return AsyncResponse(c.Destroy, nil)
+	return AsyncResponse(rename, nil)
 }
 
-var containerCmd = Command{"containers/{name}", false, false, containerGet, nil, nil, containerDelete}
+var containerCmd = Command{"containers/{name}", false, false, containerGet, containerPut, containerPost, containerDelete, nil}
 
 func containerStateGet(d *Daemon, r *http.Request) Response {
 	name := mux.Vars(r)["name"]
@@ -194,7 +833,7 @@ func containerStatePut(d *Daemon, r *http.Request) Response {
 	var do func() error
 	switch action {
 	case string(lxd.Start):
-		do = c.Start
+		do = func() error { return startContainer(c) }
 	case string(lxd.Stop):
 		if timeout == 0 || force {
 			do = c.Stop
@@ -207,6 +846,18 @@ func containerStatePut(d *Daemon, r *http.Request) Response {
 		do = c.Freeze
 	case string(lxd.Unfreeze):
 		do = c.Unfreeze
+	case string(lxd.Restore):
+		snapshotName, err := raw.GetString("snapshot")
+		if err != nil {
+			return BadRequest(err)
+		}
+
+		stateful, err := raw.GetBool("stateful")
+		if err != nil {
+			stateful = false
+		}
+
+		return containerRestore(c, snapshotName, stateful)
 	default:
 		return BadRequest(fmt.Errorf("unknown action %s", action))
 	}
@@ -214,7 +865,114 @@ func containerStatePut(d *Daemon, r *http.Request) Response {
 	return AsyncResponse(do, nil)
 }
 
-var containerStateCmd = Command{"containers/{name}/state", false, false, containerStateGet, containerStatePut, nil, nil}
+/*
+ * Start the container after applying its lxd config on top of its lxc config
+ * file, so that profile and config changes are picked up on every start.
+ */
+func startContainer(c *lxc.Container) error {
+	if err := loadConfig(c); err != nil {
+		return err
+	}
+
+	return c.Start()
+}
+
+/*
+ * Restore a container to one of its snapshots. Stateless restores need the
+ * container stopped. Stateful ones kill it if it's running, and bring its
+ * processes back from the snapshot's checkpoint once the rootfs is reset.
+ * The snapshot itself is left untouched, so it can be restored again.
+ */
+func containerRestore(c *lxc.Container, snapshotName string, stateful bool) Response {
+	if err := validSnapshotName(snapshotName); err != nil {
+		return BadRequest(err)
+	}
+
+	if _, err := os.Stat(snapshotRootfsDir(c, snapshotName)); err != nil {
+		return SmartError(err)
+	}
+
+	stateDir := snapshotStateDir(c, snapshotName)
+	if stateful {
+		if _, err := os.Stat(stateDir); err != nil {
+			if os.IsNotExist(err) {
+				return BadRequest(fmt.Errorf("snapshot %s has no running state", snapshotName))
+			}
+			return InternalError(err)
+		}
+	} else if c.State() != lxc.STOPPED {
+		return BadRequest(fmt.Errorf("container %s must be stopped to be restored", c.Name()))
+	}
+
+	restore := func() error {
+		if c.Running() {
+			if err := c.Stop(); err != nil {
+				return err
+			}
+		}
+
+		if err := restoreRootfs(c, snapshotName); err != nil {
+			return err
+		}
+
+		if !stateful {
+			return nil
+		}
+
+		if err := loadConfig(c); err != nil {
+			return err
+		}
+
+		return c.Restore(lxc.RestoreOptions{Directory: stateDir, Verbose: true})
+	}
+
+	return AsyncResponse(restore, nil)
+}
+
+/*
+ * Replace the container's rootfs with a copy of the snapshot's. The copy is
+ * made next to the rootfs and then renamed over it, so that the container
+ * keeps its rootfs if copying fails.
+ */
+func restoreRootfs(c *lxc.Container, snapshotName string) error {
+	rootfs := c.ConfigItem("lxc.rootfs")[0]
+	restoring := rootfs + ".restoring"
+	replaced := rootfs + ".replaced"
+
+	/* Interrupted between the two renames last time */
+	if _, err := os.Stat(rootfs); os.IsNotExist(err) {
+		if err := os.Rename(replaced, rootfs); err != nil {
+			return err
+		}
+	}
+
+	for _, dir := range []string{restoring, replaced} {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+
+	output, err := exec.Command("cp", "-a", snapshotRootfsDir(c, snapshotName), restoring).CombinedOutput()
+	if err != nil {
+		os.RemoveAll(restoring)
+		return fmt.Errorf("failed restoring rootfs: %s: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	if err := os.Rename(rootfs, replaced); err != nil {
+		os.RemoveAll(restoring)
+		return err
+	}
+
+	if err := os.Rename(restoring, rootfs); err != nil {
+		os.Rename(replaced, rootfs)
+		os.RemoveAll(restoring)
+		return err
+	}
+
+	return os.RemoveAll(replaced)
+}
+
+var containerStateCmd = Command{"containers/{name}/state", false, false, containerStateGet, containerStatePut, nil, nil, nil}
 
 func containerFileHandler(d *Daemon, r *http.Request) Response {
 	name := mux.Vars(r)["name"]
@@ -228,6 +986,25 @@ func containerFileHandler(d *Daemon, r *http.Request) Response {
 		return BadRequest(fmt.Errorf("missing path argument"))
 	}
 
+	p, err := containerFilePath(c, targetPath)
+	if err != nil {
+		return BadRequest(err)
+	}
+
+	switch r.Method {
+	case "GET":
+		return containerFileGet(r, p)
+	case "PUT":
+		return containerFilePut(r, p)
+	default:
+		return NotFound
+	}
+}
+
+/*
+ * The host path of a file in a container.
+ */
+func containerFilePath(c *lxc.Container, targetPath string) (string, error) {
 	var rootfs string
 	if c.Running() {
 		rootfs = fmt.Sprintf("/proc/%d/root", c.InitPid())
@@ -244,17 +1021,10 @@ func containerFileHandler(d *Daemon, r *http.Request) Response {
 	 */
 	p := path.Clean(path.Join(rootfs, targetPath))
 	if !strings.HasPrefix(p, path.Clean(rootfs)) {
-		return BadRequest(fmt.Errorf("%s is not in the container's rootfs", p))
+		return "", fmt.Errorf("%s is not in the container's rootfs", p)
 	}
 
-	switch r.Method {
-	case "GET":
-		return containerFileGet(r, p)
-	case "PUT":
-		return containerFilePut(r, p)
-	default:
-		return NotFound
-	}
+	return p, nil
 }
 
 type fileServe struct {
@@ -301,36 +1071,40 @@ func containerFilePut(r *http.Request, p string) Response {
 		return BadRequest(err)
 	}
 
-	err = os.MkdirAll(path.Dir(p), mode)
-	if err != nil {
+	if err := pushFile(p, uid, gid, mode, r.Body); err != nil {
 		return SmartError(err)
 	}
 
+	return EmptySyncResponse
+}
+
+func pushFile(p string, uid int, gid int, mode os.FileMode, content io.Reader) error {
+	err := os.MkdirAll(path.Dir(p), mode)
+	if err != nil {
+		return err
+	}
+
 	f, err := os.Create(p)
 	if err != nil {
-		return SmartError(err)
+		return err
 	}
 	defer f.Close()
 
 	err = f.Chmod(mode)
 	if err != nil {
-		return SmartError(err)
+		return err
 	}
 
 	err = f.Chown(uid, gid)
 	if err != nil {
-		return SmartError(err)
-	}
-
-	_, err = io.Copy(f, r.Body)
-	if err != nil {
-		return InternalError(err)
+		return err
 	}
 
-	return EmptySyncResponse
+	_, err = io.Copy(f, content)
+	return err
 }
 
-var containerFileCmd = Command{"containers/{name}/files", false, false, containerFileHandler, containerFileHandler, nil, nil}
+var containerFileCmd = Command{"containers/{name}/files", false, false, containerFileHandler, containerFileHandler, nil, nil, nil}
 
 func snapshotsDir(c *lxc.Container) string {
 	return lxd.VarPath("lxc", c.Name(), "snapshots")
@@ -348,6 +1122,147 @@ func snapshotRootfsDir(c *lxc.Container, name string) string {
 	return path.Join(snapshotDir(c, name), "rootfs")
 }
 
+/*
+ * What we keep about a snapshot besides the lxc container it is made of.
+ * Scheduled snapshots are the ones the snapshot scheduler took, and may
+ * prune. Protected snapshots can only be deleted by force, and are never
+ * pruned or expired. Snapshots don't change once taken, so their size is
+ * worked out then rather than every time they are listed.
+ */
+type snapshotMetadata struct {
+	CreationDate int64  `json:"creation_date"`
+	Description  string `json:"description"`
+	Scheduled    bool   `json:"scheduled,omitempty"`
+	Protected    bool   `json:"protected,omitempty"`
+	ExpiryDate   int64  `json:"expiry_date,omitempty"`
+	Size         int64  `json:"size,omitempty"`
+}
+
+func snapshotMetadataPath(c *lxc.Container, name string) string {
+	return path.Join(snapshotDir(c, name), "snapshot.json")
+}
+
+func writeSnapshotMetadata(c *lxc.Container, name string, meta *snapshotMetadata) error {
+	buf, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(snapshotMetadataPath(c, name), buf, 0600)
+}
+
+/*
+ * The disk space taken by everything under dir, counting hard links once.
+ */
+func diskUsage(dir string) (int64, error) {
+	seen := map[uint64]bool{}
+	var size int64
+
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		sb := fi.Sys().(*syscall.Stat_t)
+		if !fi.IsDir() && sb.Nlink > 1 {
+			if seen[sb.Ino] {
+				return nil
+			}
+			seen[sb.Ino] = true
+		}
+
+		size += sb.Blocks * 512
+		return nil
+	})
+
+	return size, err
+}
+
+func readSnapshotMetadata(c *lxc.Container, name string) (*snapshotMetadata, error) {
+	fi, err := os.Stat(snapshotDir(c, name))
+	if err != nil {
+		return nil, err
+	}
+
+	/* Snapshots taken before we kept metadata only have their mtime. */
+	meta := snapshotMetadata{CreationDate: fi.ModTime().Unix()}
+	buf, err := ioutil.ReadFile(snapshotMetadataPath(c, name))
+	if err == nil {
+		if err := json.Unmarshal(buf, &meta); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return &meta, nil
+}
+
+func snapshotInfo(c *lxc.Container, name string) (*lxd.SnapshotInfo, error) {
+	meta, err := readSnapshotMetadata(c, name)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = os.Stat(snapshotStateDir(c, name))
+	stateful := err == nil
+
+	/* Snapshots taken before we kept their size get it worked out once. */
+	if meta.Size == 0 {
+		meta.Size, err = diskUsage(snapshotDir(c, name))
+		if err != nil {
+			return nil, err
+		}
+
+		if err := writeSnapshotMetadata(c, name, meta); err != nil {
+			lxd.Logf("failed saving the size of snapshot %s of %s: %s", name, c.Name(), err)
+		}
+	}
+
+	info := lxd.SnapshotInfo{
+		Name:         name,
+		CreationDate: meta.CreationDate,
+		Size:         meta.Size,
+		Stateful:     stateful,
+		Description:  meta.Description,
+		Protected:    meta.Protected,
+		ExpiryDate:   meta.ExpiryDate,
+	}
+
+	return &info, nil
+}
+
+/*
+ * The names of the container's protected snapshots.
+ */
+func protectedSnapshots(c *lxc.Container) ([]string, error) {
+	files, err := ioutil.ReadDir(snapshotsDir(c))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	protected := []string{}
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+
+		meta, err := readSnapshotMetadata(c, file.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		if meta.Protected {
+			protected = append(protected, file.Name())
+		}
+	}
+
+	return protected, nil
+}
+
 func containerSnapshotsGet(d *Daemon, r *http.Request) Response {
 
 	name := mux.Vars(r)["name"]
@@ -363,18 +1278,21 @@ func containerSnapshotsGet(d *Daemon, r *http.Request) Response {
 	files, err := ioutil.ReadDir(snapshotsDir(c))
 	if err != nil {
 		if os.IsNotExist(err) {
-			return SyncResponse(true, []lxd.Jmap{})
+			return SyncResponse(true, []lxd.SnapshotInfo{})
 		} else {
 			return InternalError(err)
 		}
 	}
 
-	body := make([]string, 0)
+	body := make([]lxd.SnapshotInfo, 0)
 
 	for _, file := range files {
 		if file.IsDir() {
-			url := fmt.Sprintf("/%s/containers/%s/snapshots/%s", lxd.APIVersion, c.Name(), path.Base(file.Name()))
-			body = append(body, url)
+			info, err := snapshotInfo(c, file.Name())
+			if err != nil {
+				return InternalError(err)
+			}
+			body = append(body, *info)
 		}
 	}
 
@@ -402,39 +1320,70 @@ func containerSnapshotsPost(d *Daemon, r *http.Request) Response {
 		return BadRequest(err)
 	}
 
+	if err := validSnapshotName(snapshotName); err != nil {
+		return BadRequest(err)
+	}
+
 	stateful, err := raw.GetBool("stateful")
 	if err != nil {
 		return BadRequest(err)
 	}
 
-	snapshot := func() error {
+	description, err := raw.GetString("description")
+	if err != nil {
+		description = ""
+	}
 
-		if stateful {
-			dir := snapshotStateDir(c, snapshotName)
-			err := os.MkdirAll(dir, 0700)
-			if err != nil {
-				return err
-			}
+	meta := snapshotMetadata{CreationDate: time.Now().Unix(), Description: description}
 
-			opts := lxc.CheckpointOptions{Directory: dir, Stop: true, Verbose: true}
-			if err := c.Checkpoint(opts); err != nil {
-				return err
-			}
+	if protected, err := raw.GetBool("protected"); err == nil {
+		meta.Protected = protected
+	}
+
+	if expiry, err := raw.GetInt("expiry_date"); err == nil {
+		meta.ExpiryDate = int64(expiry)
+	}
+
+	return AsyncResponse(func() error { return snapshotContainer(c, snapshotName, stateful, &meta) }, nil)
+}
+
+/*
+ * Take a snapshot of a container, with its running state if stateful.
+ */
+func snapshotContainer(c *lxc.Container, snapshotName string, stateful bool, meta *snapshotMetadata) error {
+	if stateful {
+		dir := snapshotStateDir(c, snapshotName)
+		err := os.MkdirAll(dir, 0700)
+		if err != nil {
+			return err
 		}
 
-		/*
-		 * TODO: Giving the Best backend here doesn't work, but that's
-		 * what we want. So for now we use the default, which is just
-		 * the directory backend.
-		 */
-		opts := lxc.CloneOptions{ConfigPath: snapshotsDir(c), KeepName: false, KeepMAC: true}
-		return c.Clone(snapshotName, opts)
+		opts := lxc.CheckpointOptions{Directory: dir, Stop: true, Verbose: true}
+		if err := c.Checkpoint(opts); err != nil {
+			return err
+		}
+	}
+
+	/*
+	 * TODO: Giving the Best backend here doesn't work, but that's
+	 * what we want. So for now we use the default, which is just
+	 * the directory backend.
+	 */
+	opts := lxc.CloneOptions{ConfigPath: snapshotsDir(c), KeepName: false, KeepMAC: true}
+	if err := c.Clone(snapshotName, opts); err != nil {
+		return err
+	}
+
+	size, err := diskUsage(snapshotDir(c, snapshotName))
+	if err != nil {
+		return err
 	}
+	meta.Size = size
 
-	return AsyncResponse(snapshot, nil)
+	return writeSnapshotMetadata(c, snapshotName, meta)
 }
 
-var containerSnapshotsCmd = Command{"containers/{name}/snapshots", false, false, containerSnapshotsGet, nil, containerSnapshotsPost, nil}
+var containerSnapshotsCmd = Command{"containers/{name}/snapshots", false, false, containerSnapshotsGet, nil, containerSnapshotsPost, nil, nil}
 
 func snapshotHandler(d *Daemon, r *http.Request) Response {
 	containerName := mux.Vars(r)["name"]
@@ -458,40 +1407,68 @@ func snapshotHandler(d *Daemon, r *http.Request) Response {
 	switch r.Method {
 	case "GET":
 		return snapshotGet(c, snapshotName)
+	case "PUT":
+		return snapshotPut(r, c, snapshotName)
 	case "POST":
-		return snapshotPost(r, c, snapshotName)
+		return snapshotPost(d, r, c, snapshotName)
 	case "DELETE":
-		return snapshotDelete(c, snapshotName)
+		return snapshotDelete(r, c, snapshotName)
 	default:
 		return NotFound
 	}
 }
 
 func snapshotGet(c *lxc.Container, name string) Response {
-	_, err := os.Stat(snapshotStateDir(c, name))
-	body := lxd.Jmap{"name": name, "stateful": err == nil}
-	return SyncResponse(true, body)
+	info, err := snapshotInfo(c, name)
+	if err != nil {
+		return SmartError(err)
+	}
+
+	return SyncResponse(true, info)
+}
+
+/*
+ * Snapshot names end up in paths, so they can't be empty or hold a slash.
+ */
+func validSnapshotName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return fmt.Errorf("bad snapshot name '%s'", name)
+	}
+
+	return nil
 }
 
-func snapshotPost(r *http.Request, c *lxc.Container, oldName string) Response {
+/*
+ * Rename a snapshot, or with "migration" set, get it ready to be copied to
+ * another daemon.
+ */
+func snapshotPost(d *Daemon, r *http.Request, c *lxc.Container, oldName string) Response {
 	raw := lxd.Jmap{}
 	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
 		return BadRequest(err)
 	}
 
+	if migration, err := raw.GetBool("migration"); err == nil && migration {
+		return containerMigrateCopy(d, c, oldName, false)
+	}
+
 	newName, err := raw.GetString("name")
 	if err != nil {
 		return BadRequest(err)
 	}
 
+	if err := validSnapshotName(newName); err != nil {
+		return BadRequest(err)
+	}
+
 	oldDir := snapshotDir(c, oldName)
 	newDir := snapshotDir(c, newName)
 
 	_, err = os.Stat(newDir)
-	if !os.IsNotExist(err) {
-		return InternalError(err)
-	} else if err == nil {
+	if err == nil {
 		return BadRequest(fmt.Errorf("snapshot already exists"))
+	} else if !os.IsNotExist(err) {
+		return InternalError(err)
 	}
 
 	/*
@@ -500,12 +1477,66 @@ func snapshotPost(r *http.Request, c *lxc.Container, oldName string) Response {
 	 * out from under criu will cause it to fail, but it may be useful to
 	 * do something for stateless ones.
 	 */
-	return AsyncResponse(func() error { return os.Rename(oldDir, newDir) }, nil)
+	rename := func() error {
+		if err := os.Rename(oldDir, newDir); err != nil {
+			return err
+		}
+
+		return rewriteConfigPaths(path.Join(newDir, "config"), oldDir, newDir)
+	}
+
+	return AsyncResponse(rename, nil)
+}
+
+/*
+ * Change whether a snapshot is protected and when it expires; keys which
+ * aren't given are left alone.
+ */
+func snapshotPut(r *http.Request, c *lxc.Container, name string) Response {
+	raw := lxd.Jmap{}
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		return BadRequest(err)
+	}
+
+	meta, err := readSnapshotMetadata(c, name)
+	if err != nil {
+		return SmartError(err)
+	}
+
+	if _, ok := raw["protected"]; ok {
+		meta.Protected, err = raw.GetBool("protected")
+		if err != nil {
+			return BadRequest(err)
+		}
+	}
+
+	if _, ok := raw["expiry_date"]; ok {
+		expiry, err := raw.GetInt("expiry_date")
+		if err != nil {
+			return BadRequest(err)
+		}
+		meta.ExpiryDate = int64(expiry)
+	}
+
+	if err := writeSnapshotMetadata(c, name, meta); err != nil {
+		return InternalError(err)
+	}
+
+	return EmptySyncResponse
 }
 
-func snapshotDelete(c *lxc.Container, name string) Response {
+func snapshotDelete(r *http.Request, c *lxc.Container, name string) Response {
+	meta, err := readSnapshotMetadata(c, name)
+	if err != nil {
+		return SmartError(err)
+	}
+
+	if meta.Protected && !forced(r) {
+		return BadRequest(fmt.Errorf("snapshot %s is protected", name))
+	}
+
 	dir := snapshotDir(c, name)
 	return AsyncResponse(func() error { return os.RemoveAll(dir) }, nil)
 }
 
-var containerSnapshotCmd = Command{"containers/{name}/snapshots/{snapshotName}", false, false, snapshotHandler, nil, snapshotHandler, snapshotHandler}
+var containerSnapshotCmd = Command{"containers/{name}/snapshots/{snapshotName}", false, false, snapshotHandler, snapshotHandler, snapshotHandler, snapshotHandler, nil}
@@ -10,9 +10,11 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/lxc/lxd"
+	"gopkg.in/lxc/go-lxc.v2"
 	"gopkg.in/tomb.v2"
 )
 
@@ -27,6 +29,9 @@ type Daemon struct {
 	keyf        string
 	mux         *mux.Router
 	clientCerts map[string]x509.Certificate
+
+	imageCacheAge    time.Duration
+	snapshotInterval time.Duration
 }
 
 type Command struct {
@@ -37,6 +42,12 @@ type Command struct {
 	PUT           func(d *Daemon, r *http.Request) Response
 	POST          func(d *Daemon, r *http.Request) Response
 	DELETE        func(d *Daemon, r *http.Request) Response
+
+	/*
+	 * Decides whether an untrusted client may GET this particular
+	 * resource, for routes where only some resources are public.
+	 */
+	publicGet func(d *Daemon, r *http.Request) bool
 }
 
 func readMyCert() (string, string, error) {
@@ -105,6 +116,8 @@ func (d *Daemon) createCmd(version string, c Command) {
 			lxd.Debugf("handling %s %s", r.Method, r.URL.RequestURI())
 		} else if r.Method == "GET" && c.untrustedGet {
 			lxd.Debugf("allowing untrusted GET to %s", r.URL.RequestURI())
+		} else if r.Method == "GET" && c.publicGet != nil && c.publicGet(d, r) {
+			lxd.Debugf("allowing untrusted GET to public %s", r.URL.RequestURI())
 		} else if r.Method == "POST" && c.untrustedPost {
 			lxd.Debugf("allowing untrusted POST to %s", r.URL.RequestURI())
 		} else {
@@ -152,9 +165,12 @@ func (d *Daemon) createCmd(version string, c Command) {
 	})
 }
 
-// StartDaemon starts the lxd daemon with the provided configuration.
-func StartDaemon(listenAddr string) (*Daemon, error) {
-	d := &Daemon{}
+// StartDaemon starts the lxd daemon with the provided configuration. Cached
+// images unused for imageCacheAge are pruned, a zero age meaning they are
+// kept until they expire. Scheduled and expired snapshots are looked for
+// every snapshotInterval.
+func StartDaemon(listenAddr string, imageCacheAge time.Duration, snapshotInterval time.Duration) (*Daemon, error) {
+	d := &Daemon{imageCacheAge: imageCacheAge, snapshotInterval: snapshotInterval}
 
 	d.lxcpath = lxd.VarPath("lxc")
 	err := os.MkdirAll(lxd.VarPath("/"), 0755)
@@ -176,6 +192,11 @@ func StartDaemon(listenAddr string) (*Daemon, error) {
 	// TODO load known client certificates
 	readSavedClientCAList(d)
 
+	err = initDefaultProfile()
+	if err != nil {
+		return nil, err
+	}
+
 	d.mux = mux.NewRouter()
 
 	d.mux.HandleFunc("/shell", d.serveShell)
@@ -202,6 +223,13 @@ func StartDaemon(listenAddr string) (*Daemon, error) {
 			d.id_map.Uidrange,
 			d.id_map.Gidmin,
 			d.id_map.Gidrange)
+
+		containers := lxc.DefinedContainers(d.lxcpath)
+		for i := range containers {
+			if err := remapContainer(d, &containers[i]); err != nil {
+				lxd.Logf("failed remapping %s: %s", containers[i].Name(), err)
+			}
+		}
 	}
 
 	unixAddr, err := net.ResolveUnixAddr("unix", lxd.VarPath("unix.socket"))
@@ -234,6 +262,10 @@ func StartDaemon(listenAddr string) (*Daemon, error) {
 	}
 
 	d.tomb.Go(func() error { return http.Serve(d.unixl, d.mux) })
+
+	d.tomb.Go(d.imageCachePruner)
+	d.tomb.Go(d.snapshotScheduler)
+
 	return d, nil
 }
 
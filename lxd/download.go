@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/lxc/lxd"
+	"gopkg.in/lxc/go-lxc.v2"
+)
+
+/*
+ * The releases we pick when the user only asked for a distro, e.g.
+ * "images:ubuntu".
+ */
+var defaultReleases = map[string]string{
+	"ubuntu": "trusty",
+	"debian": "jessie",
+}
+
+/*
+ * The lxc-images architecture names differ from go's.
+ */
+var imageArchs = map[string]string{
+	"386":     "i386",
+	"amd64":   "amd64",
+	"arm":     "armhf",
+	"arm64":   "arm64",
+	"ppc64le": "ppc64el",
+}
+
+func hostArch() (string, error) {
+	arch, ok := imageArchs[runtime.GOARCH]
+	if !ok {
+		return "", fmt.Errorf("no images available for %s", runtime.GOARCH)
+	}
+
+	return arch, nil
+}
+
+/*
+ * Check an lxc-images url of the form https+lxc-images://<server>. Plain http
+ * is only accepted for image servers the user marked insecure, e.g. a local
+ * index server in tests.
+ */
+func checkImageServer(url string, insecure bool) error {
+	for _, scheme := range []string{"https", "http"} {
+		prefix := scheme + "+lxc-images://"
+		if strings.HasPrefix(url, prefix) {
+			if strings.TrimSuffix(strings.TrimPrefix(url, prefix), "/") == "" {
+				return fmt.Errorf("missing server in %s", url)
+			}
+
+			if scheme == "http" && !insecure {
+				return fmt.Errorf("%s is a plain http image server, which is only used when marked insecure", url)
+			}
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unsupported image server %s", url)
+}
+
+/*
+ * Turn an image name as found in the image registry, e.g.
+ * "lxc-images/ubuntu/trusty/amd64" or just "debian/jessie", into the
+ * distro, release, architecture and variant of the image. Missing releases
+ * and architectures default to the recommended ones for this host. insecure
+ * is whether the user marked the image server as insecure.
+ */
+func downloadOptions(url string, name string, variant string, insecure bool) (*lxc.TemplateOptions, error) {
+	if err := checkImageServer(url, insecure); err != nil {
+		return nil, err
+	}
+
+	fields := strings.Split(strings.TrimPrefix(name, "lxc-images/"), "/")
+	if len(fields) > 4 || fields[0] == "" {
+		return nil, fmt.Errorf("bad image name %s, expected distro/release/arch[/variant]", name)
+	}
+
+	opts := lxc.TemplateOptions{
+		Distro:  fields[0],
+		Variant: variant,
+	}
+
+	if len(fields) > 1 {
+		opts.Release = fields[1]
+	} else if release, ok := defaultReleases[opts.Distro]; ok {
+		opts.Release = release
+	} else {
+		return nil, fmt.Errorf("no default release for %s, please specify one", opts.Distro)
+	}
+
+	if len(fields) > 2 {
+		opts.Arch = fields[2]
+	} else {
+		var err error
+		opts.Arch, err = hostArch()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(fields) > 3 {
+		if variant != "" && variant != fields[3] {
+			return nil, fmt.Errorf("conflicting variants %s and %s", fields[3], variant)
+		}
+		opts.Variant = fields[3]
+	}
+
+	if opts.Variant == "" {
+		opts.Variant = "default"
+	}
+
+	return &opts, nil
+}
+
+/*
+ * Where the lxc config files images from image servers include live.
+ */
+const lxcTemplateConfig = "/usr/share/lxc/config"
+
+/*
+ * Download an image from an image server into a cached image, and return
+ * its fingerprint. insecure is whether the user marked the image server as
+ * insecure.
+ */
+func fetchImage(d *Daemon, url string, opts *lxc.TemplateOptions, insecure bool) (string, error) {
+	base, err := lxd.ImageServerBase(url)
+	if err != nil {
+		return "", err
+	}
+
+	imagePath, err := lxd.FindServerImage(base, opts.Distro, opts.Release, opts.Arch, opts.Variant)
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := imageTempDir("download_")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	err = lxd.DownloadImage(base, imagePath, dir)
+	if err != nil && err != lxd.ErrNoSignature {
+		return "", err
+	}
+
+	return cacheServerImage(d, dir, imageCacheSource(url, opts), opts, insecure)
+}
@@ -25,4 +25,4 @@ func fingerGet(d *Daemon, r *http.Request) Response {
 	return SyncResponse(true, resp)
 }
 
-var fingerCmd = Command{"finger", true, false, fingerGet, nil, nil, nil}
+var fingerCmd = Command{"finger", true, false, fingerGet, nil, nil, nil, nil}
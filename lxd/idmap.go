@@ -2,12 +2,15 @@ package main
 
 import (
 	"bufio"
+	"encoding/binary"
 	"fmt"
 	"os"
 	"os/user"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 )
 
 /*
@@ -103,3 +106,326 @@ func NewIdmap() (*Idmap, error) {
 	m.Gidrange = grange
 	return m, nil
 }
+
+/*
+ * The map as seen from inside the container, where it starts at 0. This is
+ * how rootfs ownership is stored in images and migration tarballs.
+ */
+func (m *Idmap) containerView() *Idmap {
+	return &Idmap{Uidmin: 0, Uidrange: m.Uidrange, Gidmin: 0, Gidrange: m.Gidrange}
+}
+
+func shiftId(id uint, fromMin uint, fromRange uint, toMin uint, toRange uint) (uint, error) {
+	if id < fromMin || id >= fromMin+fromRange {
+		return 0, fmt.Errorf("%d is outside of the idmap", id)
+	}
+
+	if id-fromMin >= toRange {
+		return 0, fmt.Errorf("%d doesn't fit in the new idmap", id)
+	}
+
+	return toMin + id - fromMin, nil
+}
+
+/*
+ * Map a uid or gid from this map's range to the same offset in to's.
+ */
+func (m *Idmap) shiftUid(uid uint, to *Idmap) (uint, error) {
+	return shiftId(uid, m.Uidmin, m.Uidrange, to.Uidmin, to.Uidrange)
+}
+
+func (m *Idmap) shiftGid(gid uint, to *Idmap) (uint, error) {
+	return shiftId(gid, m.Gidmin, m.Gidrange, to.Gidmin, to.Gidrange)
+}
+
+/*
+ * The extended attributes which hold ids, and the bits of their format
+ * (see acl_ea.h and linux/capability.h) we need to shift those.
+ */
+const (
+	aclAccessXattr  = "system.posix_acl_access"
+	aclDefaultXattr = "system.posix_acl_default"
+	capsXattr       = "security.capability"
+
+	aclVersion = 2
+	aclUser    = 0x02
+	aclGroup   = 0x08
+
+	capsRevisionMask = 0xff000000
+	capsRevision3    = 0x03000000
+	capsSize3        = 24
+)
+
+/*
+ * Shift the ids of the named users and groups of an ACL, as stored in
+ * system.posix_acl_*: a version, then (tag, permissions, id) entries.
+ */
+func shiftACL(acl []byte, from *Idmap, to *Idmap) ([]byte, error) {
+	if len(acl) < 4 || (len(acl)-4)%8 != 0 || binary.LittleEndian.Uint32(acl) != aclVersion {
+		return nil, fmt.Errorf("unsupported ACL")
+	}
+
+	shifted := append([]byte{}, acl...)
+	for i := 4; i < len(shifted); i += 8 {
+		id := uint(binary.LittleEndian.Uint32(shifted[i+4:]))
+
+		var err error
+		switch binary.LittleEndian.Uint16(shifted[i:]) {
+		case aclUser:
+			id, err = from.shiftUid(id, to)
+		case aclGroup:
+			id, err = from.shiftGid(id, to)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		binary.LittleEndian.PutUint32(shifted[i+4:], uint32(id))
+	}
+
+	return shifted, nil
+}
+
+/*
+ * Shift the root uid of namespaced (revision 3) file capabilities, the only
+ * ones which hold an id.
+ */
+func shiftCaps(caps []byte, from *Idmap, to *Idmap) ([]byte, error) {
+	if len(caps) < 4 {
+		return nil, fmt.Errorf("unsupported file capabilities")
+	}
+
+	if binary.LittleEndian.Uint32(caps)&capsRevisionMask != capsRevision3 {
+		return caps, nil
+	}
+
+	if len(caps) != capsSize3 {
+		return nil, fmt.Errorf("unsupported file capabilities")
+	}
+
+	rootid, err := from.shiftUid(uint(binary.LittleEndian.Uint32(caps[20:])), to)
+	if err != nil {
+		return nil, err
+	}
+
+	shifted := append([]byte{}, caps...)
+	binary.LittleEndian.PutUint32(shifted[20:], uint32(rootid))
+	return shifted, nil
+}
+
+/*
+ * Shift the value of one of the extended attributes which hold ids.
+ */
+func shiftXattr(name string, value []byte, from *Idmap, to *Idmap) ([]byte, error) {
+	if name == capsXattr {
+		return shiftCaps(value, from, to)
+	}
+
+	return shiftACL(value, from, to)
+}
+
+/*
+ * What shifting a rootfs does to the filesystem, so that it can be done to
+ * something else, e.g. a plain directory tree with a fake chown. getxattr
+ * returns nil for attributes which aren't set.
+ */
+type shiftOps struct {
+	lchown   func(path string, uid int, gid int) error
+	chmod    func(path string, mode os.FileMode) error
+	getxattr func(path string, name string) ([]byte, error)
+	setxattr func(path string, name string, value []byte) error
+}
+
+var hostShiftOps = &shiftOps{os.Lchown, os.Chmod, getxattr, setxattr}
+
+func getxattr(path string, name string) ([]byte, error) {
+	size, err := syscall.Getxattr(path, name, nil)
+	if err == syscall.ENODATA || err == syscall.ENOTSUP {
+		return nil, nil
+	} else if err != nil {
+		return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+	}
+
+	value := make([]byte, size)
+	size, err = syscall.Getxattr(path, name, value)
+	if err != nil {
+		return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+	}
+
+	return value[:size], nil
+}
+
+func setxattr(path string, name string, value []byte) error {
+	if err := syscall.Setxattr(path, name, value, 0); err != nil {
+		return &os.PathError{Op: "setxattr", Path: path, Err: err}
+	}
+
+	return nil
+}
+
+/*
+ * The extended attributes holding ids which a file may have. Symlinks have
+ * none, and only directories have default ACLs.
+ */
+func idXattrs(fi os.FileInfo) []string {
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+
+	if fi.IsDir() {
+		return []string{aclAccessXattr, aclDefaultXattr}
+	}
+
+	return []string{aclAccessXattr, capsXattr}
+}
+
+/*
+ * The tar flags which restore the extended attributes holding ids, as
+ * written by tarRootfs.
+ */
+var idXattrTarFlags = []string{
+	"--xattrs",
+	"--xattrs-include=" + aclAccessXattr,
+	"--xattrs-include=" + aclDefaultXattr,
+	"--xattrs-include=" + capsXattr,
+}
+
+/*
+ * The extended attributes holding ids which the file at p has, shifted from
+ * one map to the other, as found in tar headers.
+ */
+func shiftedXattrs(p string, fi os.FileInfo, from *Idmap, to *Idmap, ops *shiftOps) (map[string]string, error) {
+	xattrs := map[string]string{}
+	for _, name := range idXattrs(fi) {
+		value, err := ops.getxattr(p, name)
+		if err != nil {
+			return nil, err
+		}
+
+		if value == nil {
+			continue
+		}
+
+		shifted, err := shiftXattr(name, value, from, to)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %s", p, name, err)
+		}
+		xattrs[name] = string(shifted)
+	}
+
+	return xattrs, nil
+}
+
+/*
+ * Shift one file's ownership, ACLs and file capabilities from one map to
+ * the other.
+ */
+func shiftFile(p string, fi os.FileInfo, from *Idmap, to *Idmap, ops *shiftOps) error {
+	sb := fi.Sys().(*syscall.Stat_t)
+	uid, err := from.shiftUid(uint(sb.Uid), to)
+	if err != nil {
+		return fmt.Errorf("%s: %s", p, err)
+	}
+
+	gid, err := from.shiftGid(uint(sb.Gid), to)
+	if err != nil {
+		return fmt.Errorf("%s: %s", p, err)
+	}
+
+	/* chown drops file capabilities, so read them all first. */
+	xattrs := map[string][]byte{}
+	for _, name := range idXattrs(fi) {
+		value, err := ops.getxattr(p, name)
+		if err != nil {
+			return err
+		}
+
+		if value == nil {
+			continue
+		}
+
+		xattrs[name], err = shiftXattr(name, value, from, to)
+		if err != nil {
+			return fmt.Errorf("%s: %s: %s", p, name, err)
+		}
+	}
+
+	if err := ops.lchown(p, int(uid), int(gid)); err != nil {
+		return err
+	}
+
+	/* chown drops the setuid and setgid bits too, put them back. */
+	if fi.Mode()&os.ModeSymlink == 0 {
+		if err := ops.chmod(p, fi.Mode()); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range idXattrs(fi) {
+		if value, ok := xattrs[name]; ok {
+			if err := ops.setxattr(p, name, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+ * Shift the ownership of everything under dir, along with the ids in ACLs
+ * and file capabilities, from one map's range to the other's. Hard linked
+ * files are only shifted once.
+ */
+func shiftRootfs(dir string, from *Idmap, to *Idmap, ops *shiftOps) error {
+	/* inodes already shifted */
+	shifted := map[uint64]bool{}
+
+	return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		sb := fi.Sys().(*syscall.Stat_t)
+		if !fi.IsDir() && sb.Nlink > 1 {
+			if shifted[sb.Ino] {
+				return nil
+			}
+			shifted[sb.Ino] = true
+		}
+
+		return shiftFile(p, fi, from, to, ops)
+	})
+}
+
+/*
+ * Shift the ownership of everything under dir from the container's point of
+ * view (uid 0 is root) into this map's range on the host. This is what makes
+ * a rootfs unpacked from an image or migration tarball usable by an
+ * unprivileged container.
+ */
+func (m *Idmap) ShiftRootfs(dir string) error {
+	return shiftRootfs(dir, m.containerView(), m, hostShiftOps)
+}
+
+/*
+ * Shift the ownership of everything under dir from the range of the map
+ * it was used with into this one's, e.g. when the allocation changed.
+ */
+func (m *Idmap) ShiftRootfsFrom(dir string, from *Idmap) error {
+	return shiftRootfs(dir, from, m, hostShiftOps)
+}
+
+/*
+ * The reverse of the shift done by ShiftRootfs: map a host uid and gid back
+ * to what they are inside the container.
+ */
+func (m *Idmap) Unshift(uid uint, gid uint) (uint, uint, error) {
+	if uid < m.Uidmin || uid >= m.Uidmin+m.Uidrange || gid < m.Gidmin || gid >= m.Gidmin+m.Gidrange {
+		return 0, 0, fmt.Errorf("%d:%d is outside of the idmap", uid, gid)
+	}
+
+	return uid - m.Uidmin, gid - m.Gidmin, nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/*
+ * A filesystem which records what shifting does to it instead of doing it,
+ * so that the tests needn't be privileged. Files are all owned by the user
+ * running the tests, so the maps are set up around their uid and gid.
+ */
+type fakeShift struct {
+	xattrs map[string]map[string][]byte
+	chowns map[string][2]int
+	modes  map[string]os.FileMode
+	set    map[string]map[string][]byte
+}
+
+func newFakeShift() *fakeShift {
+	return &fakeShift{
+		xattrs: map[string]map[string][]byte{},
+		chowns: map[string][2]int{},
+		modes:  map[string]os.FileMode{},
+		set:    map[string]map[string][]byte{},
+	}
+}
+
+func (f *fakeShift) ops() *shiftOps {
+	return &shiftOps{
+		lchown: func(p string, uid int, gid int) error {
+			if _, ok := f.chowns[p]; ok {
+				return &os.PathError{Op: "lchown", Path: p, Err: os.ErrExist}
+			}
+			f.chowns[p] = [2]int{uid, gid}
+			return nil
+		},
+		chmod: func(p string, mode os.FileMode) error {
+			f.modes[p] = mode
+			return nil
+		},
+		getxattr: func(p string, name string) ([]byte, error) {
+			return f.xattrs[p][name], nil
+		},
+		setxattr: func(p string, name string, value []byte) error {
+			if f.set[p] == nil {
+				f.set[p] = map[string][]byte{}
+			}
+			f.set[p][name] = value
+			return nil
+		},
+	}
+}
+
+func (f *fakeShift) setXattr(p string, name string, value []byte) {
+	if f.xattrs[p] == nil {
+		f.xattrs[p] = map[string][]byte{}
+	}
+	f.xattrs[p][name] = value
+}
+
+type aclEntry struct {
+	tag uint16
+	id  uint32
+}
+
+func testACL(entries ...aclEntry) []byte {
+	acl := make([]byte, 4+8*len(entries))
+	binary.LittleEndian.PutUint32(acl, aclVersion)
+	for i, e := range entries {
+		binary.LittleEndian.PutUint16(acl[4+8*i:], e.tag)
+		binary.LittleEndian.PutUint16(acl[6+8*i:], 7)
+		binary.LittleEndian.PutUint32(acl[8+8*i:], e.id)
+	}
+	return acl
+}
+
+func testCaps(revision uint32, size int, rootid uint32) []byte {
+	caps := make([]byte, size)
+	binary.LittleEndian.PutUint32(caps, revision|0x1)
+	binary.LittleEndian.PutUint32(caps[4:], 0x400)
+	if size == capsSize3 {
+		binary.LittleEndian.PutUint32(caps[20:], rootid)
+	}
+	return caps
+}
+
+/*
+ * A tree with a directory, a regular file, a setuid file, a symlink and two
+ * hard links to the same file.
+ */
+func testTree(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "lxd_idmap_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"etc/hostname", "su", "a"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.Chmod(filepath.Join(dir, "su"), 0755|os.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink("etc/hostname", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Link(filepath.Join(dir, "a"), filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+/* The maps shifted from and to */
+func testMaps() (*Idmap, *Idmap) {
+	from := &Idmap{Uidmin: uint(os.Getuid()), Uidrange: 65536, Gidmin: uint(os.Getgid()), Gidrange: 65536}
+	to := &Idmap{Uidmin: 100000, Uidrange: 65536, Gidmin: 200000, Gidrange: 65536}
+	return from, to
+}
+
+func TestShiftRootfsOwnership(t *testing.T) {
+	dir := testTree(t)
+	defer os.RemoveAll(dir)
+
+	from, to := testMaps()
+	fake := newFakeShift()
+	if err := shiftRootfs(dir, from, to, fake.ops()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"", "etc", "etc/hostname", "su", "link"} {
+		owner, ok := fake.chowns[filepath.Join(dir, name)]
+		if !ok {
+			t.Errorf("%q wasn't shifted", name)
+		} else if owner != [2]int{100000, 200000} {
+			t.Errorf("%q shifted to %d:%d, expected 100000:200000", name, owner[0], owner[1])
+		}
+	}
+
+	if _, ok := fake.modes[filepath.Join(dir, "link")]; ok {
+		t.Errorf("symlink was chmod'ed")
+	}
+}
+
+func TestShiftRootfsOutOfRange(t *testing.T) {
+	dir := testTree(t)
+	defer os.RemoveAll(dir)
+
+	from, to := testMaps()
+
+	/* Owned by an id below the range shifted from */
+	below := *from
+	below.Uidmin++
+	err := shiftRootfs(dir, &below, to, newFakeShift().ops())
+	if err == nil || !strings.Contains(err.Error(), "outside of the idmap") {
+		t.Errorf("shifting a uid below the map: %v", err)
+	}
+
+	below = *from
+	below.Gidmin++
+	err = shiftRootfs(dir, &below, to, newFakeShift().ops())
+	if err == nil || !strings.Contains(err.Error(), "outside of the idmap") {
+		t.Errorf("shifting a gid below the map: %v", err)
+	}
+
+	/* An ACL entry beyond the range shifted from */
+	fake := newFakeShift()
+	fake.setXattr(filepath.Join(dir, "su"), aclAccessXattr, testACL(aclEntry{aclUser, uint32(from.Uidmin + from.Uidrange)}))
+	err = shiftRootfs(dir, from, to, fake.ops())
+	if err == nil || !strings.Contains(err.Error(), "outside of the idmap") {
+		t.Errorf("shifting an ACL user beyond the map: %v", err)
+	}
+
+	/* A target range too small for the ids */
+	from.Uidmin = 0
+	small := *to
+	small.Uidrange = uint(os.Getuid())
+	err = shiftRootfs(dir, from, &small, newFakeShift().ops())
+	if err == nil || !strings.Contains(err.Error(), "doesn't fit") {
+		t.Errorf("shifting into a smaller map: %v", err)
+	}
+}
+
+func TestShiftRootfsXattrs(t *testing.T) {
+	dir := testTree(t)
+	defer os.RemoveAll(dir)
+
+	from, to := testMaps()
+	fake := newFakeShift()
+
+	uid := uint32(from.Uidmin)
+	gid := uint32(from.Gidmin)
+	etc := filepath.Join(dir, "etc")
+	hostname := filepath.Join(dir, "etc/hostname")
+	su := filepath.Join(dir, "su")
+
+	/* Owner, named user and named group entries, and an ACL mask */
+	fake.setXattr(etc, aclAccessXattr, testACL(aclEntry{0x01, 0xffffffff}, aclEntry{aclUser, uid + 5}, aclEntry{aclGroup, gid + 7}, aclEntry{0x10, 0xffffffff}))
+	fake.setXattr(etc, aclDefaultXattr, testACL(aclEntry{aclGroup, gid + 9}))
+	fake.setXattr(hostname, capsXattr, testCaps(capsRevision3, capsSize3, uid))
+	fake.setXattr(su, capsXattr, testCaps(0x02000000, 20, 0))
+
+	if err := shiftRootfs(dir, from, to, fake.ops()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]map[string][]byte{
+		etc: {
+			aclAccessXattr:  testACL(aclEntry{0x01, 0xffffffff}, aclEntry{aclUser, 100005}, aclEntry{aclGroup, 200007}, aclEntry{0x10, 0xffffffff}),
+			aclDefaultXattr: testACL(aclEntry{aclGroup, 200009}),
+		},
+		/* The root uid of namespaced capabilities */
+		hostname: {capsXattr: testCaps(capsRevision3, capsSize3, 100000)},
+		/* Capabilities without a root uid are only put back */
+		su: {capsXattr: testCaps(0x02000000, 20, 0)},
+	}
+
+	for p, xattrs := range expected {
+		for name, value := range xattrs {
+			if !bytes.Equal(fake.set[p][name], value) {
+				t.Errorf("%s %s: got %x, expected %x", p, name, fake.set[p][name], value)
+			}
+		}
+		if len(fake.set[p]) != len(xattrs) {
+			t.Errorf("%s: %d xattrs set, expected %d", p, len(fake.set[p]), len(xattrs))
+		}
+	}
+
+	/* The same, as put in tar headers */
+	fi, err := os.Lstat(etc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers, err := shiftedXattrs(etc, fi, from, to, fake.ops())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, value := range expected[etc] {
+		if headers[name] != string(value) {
+			t.Errorf("tar header %s: got %x, expected %x", name, headers[name], value)
+		}
+	}
+}
+
+func TestShiftRootfsHardlinks(t *testing.T) {
+	dir := testTree(t)
+	defer os.RemoveAll(dir)
+
+	from, to := testMaps()
+	fake := newFakeShift()
+
+	if err := shiftRootfs(dir, from, to, fake.ops()); err != nil {
+		t.Fatal(err)
+	}
+
+	/* Shifting it through the second link would shift it twice */
+	_, a := fake.chowns[filepath.Join(dir, "a")]
+	_, b := fake.chowns[filepath.Join(dir, "b")]
+	if a == b {
+		t.Errorf("hard linked file shifted through a: %v, b: %v, expected only one", a, b)
+	}
+}
+
+func TestShiftRootfsSetuid(t *testing.T) {
+	dir := testTree(t)
+	defer os.RemoveAll(dir)
+
+	from, to := testMaps()
+	fake := newFakeShift()
+	if err := shiftRootfs(dir, from, to, fake.ops()); err != nil {
+		t.Fatal(err)
+	}
+
+	mode, ok := fake.modes[filepath.Join(dir, "su")]
+	if !ok || mode&os.ModeSetuid == 0 || mode.Perm() != 0755 {
+		t.Errorf("setuid file's mode not put back after chown: %v", mode)
+	}
+
+	if mode := fake.modes[filepath.Join(dir, "etc/hostname")]; mode.Perm() != 0644 {
+		t.Errorf("mode changed to %v", mode)
+	}
+}
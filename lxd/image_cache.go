@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lxc/lxd"
+	"gopkg.in/lxc/go-lxc.v2"
+)
+
+/*
+ * Images downloaded from an image server are turned into cached images in
+ * the image store, which containers are then created from, so that the next
+ * container created from the same image doesn't need to download it again.
+ * They are cached as they come from the image server, before the container's
+ * name is put in the image's templates. Cached images are used until they
+ * expire, and pruned once expired or unused for longer than the daemon's
+ * image cache age.
+ */
+
+/* How long cached images are valid when the image server didn't say */
+const imageCacheExpiry = 30 * 24 * time.Hour
+
+/* How often we look for cached images to prune */
+const imagePruneInterval = time.Hour
+
+/*
+ * The string identifying an image on an image server, which is what cached
+ * images are looked up by.
+ */
+func imageCacheSource(url string, opts *lxc.TemplateOptions) string {
+	return fmt.Sprintf("%s/%s/%s/%s/%s", strings.TrimSuffix(url, "/"), opts.Distro, opts.Release, opts.Arch, opts.Variant)
+}
+
+/*
+ * Find the most recent cached image for source which hasn't expired yet.
+ * Unverified images are only used for image servers the user marked
+ * insecure. Returns "" if there isn't any.
+ */
+func findCachedImage(source string, insecure bool) (string, error) {
+	fingerprints, err := imageFingerprints()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().Unix()
+	found := ""
+	var created int64
+	for _, fp := range fingerprints {
+		info, err := readImageInfo(fp)
+		if err != nil {
+			return "", err
+		}
+
+		if !info.Cached || info.Source != source || info.ExpiryDate <= now {
+			continue
+		}
+
+		if !info.Verified && !insecure {
+			continue
+		}
+
+		if found == "" || info.CreationDate > created {
+			found = fp
+			created = info.CreationDate
+		}
+	}
+
+	return found, nil
+}
+
+/*
+ * The metadata of an image from an image server, whose own metadata was
+ * unpacked into dir: the lxc config it comes with, the unprivileged one
+ * included, and the files it wants the container's name in.
+ */
+func serverImageMetadata(dir string, opts *lxc.TemplateOptions) (*imageMetadata, error) {
+	meta := imageMetadata{
+		Architecture: opts.Arch,
+		CreationDate: time.Now().Unix(),
+		Properties: map[string]string{
+			"os":      opts.Distro,
+			"release": opts.Release,
+			"variant": opts.Variant,
+		},
+		Config:    []lxd.Jmap{},
+		Includes:  []string{},
+		Templates: []string{},
+	}
+
+	for _, file := range []string{"config", "config-user"} {
+		buf, err := ioutil.ReadFile(path.Join(dir, file))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		for _, line := range strings.Split(string(buf), "\n") {
+			fields := strings.SplitN(line, "=", 2)
+			if len(fields) != 2 || strings.HasPrefix(strings.TrimSpace(line), "#") {
+				continue
+			}
+
+			key := strings.TrimSpace(fields[0])
+			value := strings.Replace(strings.TrimSpace(fields[1]), "LXC_TEMPLATE_CONFIG", lxcTemplateConfig, -1)
+			if key == "lxc.include" {
+				meta.Includes = append(meta.Includes, value)
+			} else {
+				meta.Config = append(meta.Config, lxd.Jmap{"key": key, "value": value})
+			}
+		}
+	}
+
+	buf, err := ioutil.ReadFile(path.Join(dir, "templates"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, template := range strings.Split(string(buf), "\n") {
+		if template = strings.TrimSpace(template); template != "" {
+			meta.Templates = append(meta.Templates, template)
+		}
+	}
+
+	return &meta, nil
+}
+
+/*
+ * When the image server says an image whose metadata was unpacked into dir
+ * expires.
+ */
+func serverImageExpiry(dir string) int64 {
+	buf, err := ioutil.ReadFile(path.Join(dir, "expiry"))
+	if err == nil {
+		date, err := strconv.ParseInt(strings.TrimSpace(string(buf)), 10, 64)
+		if err == nil {
+			return date
+		}
+	}
+
+	return time.Now().Add(imageCacheExpiry).Unix()
+}
+
+/*
+ * Turn an image's files, as found on an image server and downloaded into
+ * dir, into a cached image for source and return its fingerprint. The files
+ * are verified first, see verifyImage.
+ */
+func cacheServerImage(d *Daemon, dir string, source string, opts *lxc.TemplateOptions, insecure bool) (string, error) {
+	verified, err := verifyImage(dir, insecure)
+	if err != nil {
+		return "", err
+	}
+
+	metaDir := path.Join(dir, "meta")
+	if err := os.Mkdir(metaDir, 0700); err != nil {
+		return "", err
+	}
+
+	output, err := exec.Command("tar", "-C", metaDir, "-xJf", path.Join(dir, "meta.tar.xz")).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed unpacking image metadata: %s: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	meta, err := serverImageMetadata(metaDir, opts)
+	if err != nil {
+		return "", err
+	}
+
+	/*
+	 * The rootfs is owned as seen from inside the container, and made
+	 * for unprivileged containers without the excluded files.
+	 */
+	rootfs := path.Join(dir, "rootfs")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		return "", err
+	}
+
+	args := append([]string{"-C", rootfs, "--numeric-owner"}, idXattrTarFlags...)
+	if _, err := os.Stat(path.Join(metaDir, "excludes-user")); err == nil {
+		args = append(args, "--exclude-from", path.Join(metaDir, "excludes-user"))
+	}
+
+	output, err = exec.Command("tar", append(args, "-xpJf", path.Join(dir, "rootfs.tar.xz"))...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed unpacking image: %s: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	fingerprint, err := writeImageFrom(rootfs, d.id_map.containerView(), meta, false)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := readImageInfo(fingerprint)
+	if err != nil {
+		return "", err
+	}
+
+	info.Cached = true
+	info.Verified = verified
+	info.Source = source
+	info.ExpiryDate = serverImageExpiry(metaDir)
+	info.LastUsedDate = time.Now().Unix()
+
+	lxd.Debugf("cached %s as %s", source, fingerprint)
+	return fingerprint, writeImageInfo(info)
+}
+
+/*
+ * Remove the cached images which have expired or, unless maxAge is zero,
+ * haven't been used for maxAge.
+ */
+func pruneImageCache(maxAge time.Duration) error {
+	fingerprints, err := imageFingerprints()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, fp := range fingerprints {
+		info, err := readImageInfo(fp)
+		if err != nil {
+			return err
+		}
+
+		if !info.Cached {
+			continue
+		}
+
+		expired := info.ExpiryDate <= now.Unix()
+		unused := maxAge > 0 && now.Sub(time.Unix(info.LastUsedDate, 0)) > maxAge
+		if !expired && !unused {
+			continue
+		}
+
+		lxd.Debugf("pruning cached image %s", fp)
+		if err := removeImage(fp); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *Daemon) imageCachePruner() error {
+	ticker := time.NewTicker(imagePruneInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := pruneImageCache(d.imageCacheAge); err != nil {
+			lxd.Logf("failed pruning the image cache: %s", err)
+		}
+
+		select {
+		case <-d.tomb.Dying():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
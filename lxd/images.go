@@ -0,0 +1,603 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lxc/lxd"
+	"gopkg.in/lxc/go-lxc.v2"
+	"gopkg.in/yaml.v2"
+)
+
+/*
+ * Images are stored under VarPath("images"), as a tarball named after its
+ * SHA-256 fingerprint and a json file describing it. The tarball contains a
+ * metadata.yaml and the container's root filesystem under rootfs/.
+ */
+func imagesDir() string {
+	return lxd.VarPath("images")
+}
+
+func imagePath(fingerprint string) string {
+	return lxd.VarPath("images", fingerprint)
+}
+
+func imageInfoPath(fingerprint string) string {
+	return lxd.VarPath("images", fingerprint+".json")
+}
+
+/*
+ * A temporary directory in the image store, for the files an image is made
+ * from.
+ */
+func imageTempDir(prefix string) (string, error) {
+	if err := os.MkdirAll(imagesDir(), 0700); err != nil {
+		return "", err
+	}
+
+	return ioutil.TempDir(imagesDir(), prefix)
+}
+
+/*
+ * The metadata.yaml at the root of every image tarball. Includes are the
+ * lxc config files (usually the distro's common config) the container the
+ * image was made from was using. Templates are the files of the rootfs in
+ * which LXC_NAME stands for the name of the container, like in images from
+ * image servers. Application images imported from an OCI or docker image
+ * keep the config they came with in OCI.
+ */
+type imageMetadata struct {
+	Architecture string            `yaml:"architecture"`
+	CreationDate int64             `yaml:"creation_date"`
+	Properties   map[string]string `yaml:"properties"`
+	Config       []lxd.Jmap        `yaml:"config,omitempty"`
+	Includes     []string          `yaml:"includes,omitempty"`
+	Templates    []string          `yaml:"templates,omitempty"`
+	OCI          *ociImageConfig   `yaml:"oci,omitempty"`
+}
+
+var fingerprintRegexp = regexp.MustCompile("^[0-9a-f]{64}$")
+
+func imageFingerprints() ([]string, error) {
+	files, err := ioutil.ReadDir(imagesDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+
+	fingerprints := []string{}
+	for _, file := range files {
+		if !file.IsDir() && fingerprintRegexp.MatchString(file.Name()) {
+			fingerprints = append(fingerprints, file.Name())
+		}
+	}
+
+	return fingerprints, nil
+}
+
+/*
+ * Find the image a (possibly abbreviated) fingerprint refers to.
+ */
+func findImage(prefix string) (string, error) {
+	if prefix == "" {
+		return "", fmt.Errorf("missing image fingerprint")
+	}
+
+	fingerprints, err := imageFingerprints()
+	if err != nil {
+		return "", err
+	}
+
+	found := ""
+	for _, fp := range fingerprints {
+		if strings.HasPrefix(fp, prefix) {
+			if found != "" {
+				return "", fmt.Errorf("ambiguous image fingerprint %s", prefix)
+			}
+			found = fp
+		}
+	}
+
+	if found == "" {
+		return "", os.ErrNotExist
+	}
+
+	return found, nil
+}
+
+func readImageInfo(fingerprint string) (*lxd.ImageInfo, error) {
+	buf, err := ioutil.ReadFile(imageInfoPath(fingerprint))
+	if err != nil {
+		return nil, err
+	}
+
+	info := lxd.ImageInfo{}
+	if err := json.Unmarshal(buf, &info); err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+func writeImageInfo(info *lxd.ImageInfo) error {
+	buf, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(imageInfoPath(info.Fingerprint), buf, 0600)
+}
+
+/*
+ * Record that an image was just used to create a container, which keeps it
+ * from being pruned if it's a cached one.
+ */
+func touchImage(fingerprint string) error {
+	info, err := readImageInfo(fingerprint)
+	if err != nil {
+		return err
+	}
+
+	info.LastUsedDate = time.Now().Unix()
+	return writeImageInfo(info)
+}
+
+func removeImage(fingerprint string) error {
+	if err := removeImageAliases(fingerprint); err != nil {
+		return err
+	}
+
+	if err := os.Remove(imagePath(fingerprint)); err != nil {
+		return err
+	}
+
+	return os.Remove(imageInfoPath(fingerprint))
+}
+
+func readImageMetadata(tarball string) (*imageMetadata, error) {
+	out, err := exec.Command("tar", "--occurrence", "-xOf", tarball, "metadata.yaml").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed reading image metadata: %s", err)
+	}
+
+	meta := imageMetadata{}
+	if err := yaml.Unmarshal(out, &meta); err != nil {
+		return nil, err
+	}
+
+	if meta.Properties == nil {
+		meta.Properties = map[string]string{}
+	}
+
+	return &meta, nil
+}
+
+/*
+ * Whether an image has been flagged public, i.e. may be seen and fetched by
+ * untrusted clients.
+ */
+func imageIsPublic(fingerprint string) bool {
+	info, err := readImageInfo(fingerprint)
+	if err != nil {
+		return false
+	}
+
+	return info.Public
+}
+
+/*
+ * Anyone may list images, untrusted clients only get to see the public ones.
+ */
+func imagesPublicGet(d *Daemon, r *http.Request) bool {
+	return true
+}
+
+func imagePublicGet(d *Daemon, r *http.Request) bool {
+	fingerprint, err := findImage(mux.Vars(r)["fingerprint"])
+	if err != nil {
+		return false
+	}
+
+	return imageIsPublic(fingerprint)
+}
+
+func imagesGet(d *Daemon, r *http.Request) Response {
+	fingerprints, err := imageFingerprints()
+	if err != nil {
+		return InternalError(err)
+	}
+
+	trusted := d.isTrustedClient(r)
+
+	body := make([]string, 0)
+	for _, fp := range fingerprints {
+		if !trusted && !imageIsPublic(fp) {
+			continue
+		}
+		body = append(body, fmt.Sprintf("/%s/images/%s", lxd.APIVersion, fp))
+	}
+
+	return SyncResponse(true, body)
+}
+
+/*
+ * Import an image. The request body is the image tarball; its fingerprint is
+ * computed while it is received, and can be checked against the one the
+ * client expects by setting X-LXD-fingerprint. Setting X-LXD-public to "1"
+ * makes the image public. Images relayed from an image server say which one
+ * and which image with X-LXD-source-url and X-LXD-source-name, and whether
+ * the user marked the image server insecure with X-LXD-insecure. Json
+ * requests publish a container as an image instead.
+ */
+func imagesPut(d *Daemon, r *http.Request) Response {
+	if r.Header.Get("Content-Type") == "application/json" {
+		return imagesPublish(d, r)
+	}
+
+	if err := os.MkdirAll(imagesDir(), 0700); err != nil {
+		return InternalError(err)
+	}
+
+	f, err := ioutil.TempFile(imagesDir(), "upload_")
+	if err != nil {
+		return InternalError(err)
+	}
+	tmp := f.Name()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, hash), r.Body)
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return InternalError(err)
+	}
+
+	fingerprint := fmt.Sprintf("%x", hash.Sum(nil))
+	public := r.Header.Get("X-LXD-public") == "1"
+	sourceURL := r.Header.Get("X-LXD-source-url")
+	sourceName := r.Header.Get("X-LXD-source-name")
+	insecure := r.Header.Get("X-LXD-insecure") == "1"
+
+	expected := r.Header.Get("X-LXD-fingerprint")
+	if expected != "" && expected != fingerprint {
+		os.Remove(tmp)
+		return BadRequest(fmt.Errorf("fingerprint mismatch: got %s, expected %s", fingerprint, expected))
+	}
+
+	if _, err := os.Stat(imagePath(fingerprint)); err == nil {
+		os.Remove(tmp)
+		return BadRequest(fmt.Errorf("image %s already exists", fingerprint))
+	}
+
+	importImage := func(id string) error {
+		defer os.Remove(tmp)
+
+		format, err := imageTarballFormat(tmp)
+		if err != nil {
+			return err
+		}
+
+		/*
+		 * Relayed and application images are converted, which gives
+		 * them a fingerprint of their own.
+		 */
+		if format == "lxc-images" {
+			fingerprint, err := importRelayedImage(d, tmp, sourceURL, sourceName, insecure)
+			if err != nil {
+				return err
+			}
+
+			return UpdateOperationMetadata(id, lxd.Jmap{"fingerprint": fingerprint})
+		}
+
+		if format != "lxd" {
+			fingerprint, err := importOCIImage(d, tmp, format, public)
+			if err != nil {
+				return err
+			}
+
+			return UpdateOperationMetadata(id, lxd.Jmap{"fingerprint": fingerprint})
+		}
+
+		meta, err := readImageMetadata(tmp)
+		if err != nil {
+			return err
+		}
+
+		info := lxd.ImageInfo{
+			Fingerprint:  fingerprint,
+			Size:         size,
+			Architecture: meta.Architecture,
+			CreationDate: meta.CreationDate,
+			UploadDate:   time.Now().Unix(),
+			Public:       public,
+			Properties:   meta.Properties,
+		}
+
+		if err := writeImageInfo(&info); err != nil {
+			return err
+		}
+
+		return os.Rename(tmp, imagePath(fingerprint))
+	}
+
+	return AsyncResponseWithProgress(importImage, nil, lxd.Jmap{"fingerprint": fingerprint})
+}
+
+var imagesCmd = Command{"images", false, false, imagesGet, imagesPut, nil, nil, imagesPublicGet}
+
+func imageGet(d *Daemon, r *http.Request) Response {
+	fingerprint, err := findImage(mux.Vars(r)["fingerprint"])
+	if err != nil {
+		return SmartError(err)
+	}
+
+	info, err := readImageInfo(fingerprint)
+	if err != nil {
+		return InternalError(err)
+	}
+
+	return SyncResponse(true, info)
+}
+
+type imagePutReq struct {
+	Public     bool              `json:"public"`
+	Properties map[string]string `json:"properties"`
+}
+
+func imagePut(d *Daemon, r *http.Request) Response {
+	fingerprint, err := findImage(mux.Vars(r)["fingerprint"])
+	if err != nil {
+		return SmartError(err)
+	}
+
+	req := imagePutReq{}
+	if err := lxd.ReadToJson(r.Body, &req); err != nil {
+		return BadRequest(err)
+	}
+
+	info, err := readImageInfo(fingerprint)
+	if err != nil {
+		return InternalError(err)
+	}
+
+	info.Public = req.Public
+	info.Properties = req.Properties
+	if info.Properties == nil {
+		info.Properties = map[string]string{}
+	}
+
+	if err := writeImageInfo(info); err != nil {
+		return InternalError(err)
+	}
+
+	return EmptySyncResponse
+}
+
+func imageDelete(d *Daemon, r *http.Request) Response {
+	fingerprint, err := findImage(mux.Vars(r)["fingerprint"])
+	if err != nil {
+		return SmartError(err)
+	}
+
+	remove := func() error {
+		return removeImage(fingerprint)
+	}
+
+	return AsyncResponse(remove, nil)
+}
+
+var imageCmd = Command{"images/{fingerprint}", false, false, imageGet, imagePut, nil, imageDelete, imagePublicGet}
+
+type imageExport struct {
+	req         *http.Request
+	fingerprint string
+}
+
+func (r *imageExport) Render(w http.ResponseWriter) error {
+	f, err := os.Open(imagePath(r.fingerprint))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("X-LXD-fingerprint", r.fingerprint)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.tar.gz", r.fingerprint))
+
+	http.ServeContent(w, r.req, r.fingerprint, fi.ModTime(), f)
+	return nil
+}
+
+/*
+ * Stream an image's tarball. Range requests are supported, so that clients
+ * can resume interrupted downloads.
+ */
+func imageExportGet(d *Daemon, r *http.Request) Response {
+	fingerprint, err := findImage(mux.Vars(r)["fingerprint"])
+	if err != nil {
+		return SmartError(err)
+	}
+
+	if _, err := os.Stat(imagePath(fingerprint)); err != nil {
+		return SmartError(err)
+	}
+
+	return &imageExport{r, fingerprint}
+}
+
+var imageExportCmd = Command{"images/{fingerprint}/export", false, false, imageExportGet, nil, nil, nil, imagePublicGet}
+
+/*
+ * The lxc config files a container includes, which its images need to
+ * include as well.
+ */
+func lxcIncludes(c *lxc.Container) ([]string, error) {
+	buf, err := ioutil.ReadFile(c.ConfigFileName())
+	if err != nil {
+		return nil, err
+	}
+
+	includes := []string{}
+	for _, line := range strings.Split(string(buf), "\n") {
+		fields := strings.SplitN(line, "=", 2)
+		if len(fields) != 2 || strings.TrimSpace(fields[0]) != "lxc.include" {
+			continue
+		}
+		includes = append(includes, strings.TrimSpace(fields[1]))
+	}
+
+	return includes, nil
+}
+
+/*
+ * Load the same default config lxc-create would use, since we bypass it
+ * when creating containers from images.
+ */
+func loadDefaultConfig(c *lxc.Container) error {
+	conf := lxc.GlobalConfigItem("lxc.default_config")
+	if conf == "" {
+		return nil
+	}
+
+	if _, err := os.Stat(conf); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return c.LoadConfigFile(conf)
+}
+
+/*
+ * Unpack an image's rootfs into the container's directory and point the
+ * container at it and the config files the image needs. The container's
+ * config is saved by the caller.
+ */
+func createFromImage(d *Daemon, c *lxc.Container, fingerprint string) error {
+	dir := path.Join(d.lxcpath, c.Name())
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("container %s already exists", c.Name())
+	}
+
+	if err := touchImage(fingerprint); err != nil {
+		return err
+	}
+
+	meta, err := readImageMetadata(imagePath(fingerprint))
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	rootfs := path.Join(dir, "rootfs")
+	err = func() error {
+		for _, include := range meta.Includes {
+			if err := c.SetConfigItem("lxc.include", include); err != nil {
+				return err
+			}
+		}
+
+		args := append([]string{"-C", dir, "--numeric-owner"}, idXattrTarFlags...)
+		output, err := exec.Command("tar", append(args, "-xpf", imagePath(fingerprint), "rootfs")...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed unpacking image: %s: %s", err, strings.TrimSpace(string(output)))
+		}
+
+		if err := d.id_map.ShiftRootfs(rootfs); err != nil {
+			return err
+		}
+
+		if err := applyTemplates(rootfs, meta.Templates, c.Name()); err != nil {
+			return err
+		}
+
+		if err := c.SetConfigItem("lxc.rootfs", rootfs); err != nil {
+			return err
+		}
+
+		return c.SetConfigItem("lxc.utsname", c.Name())
+	}()
+
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	return nil
+}
+
+/*
+ * Put the container's name in the image's templates, as the download
+ * template does. Templates which aren't regular files within the rootfs are
+ * skipped.
+ */
+func applyTemplates(rootfs string, templates []string, name string) error {
+	if len(templates) == 0 {
+		return nil
+	}
+
+	root, err := filepath.EvalSymlinks(rootfs)
+	if err != nil {
+		return err
+	}
+
+	for _, template := range templates {
+		p, err := filepath.EvalSymlinks(path.Join(root, path.Clean("/"+template)))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+
+		if !strings.HasPrefix(p, root+"/") {
+			continue
+		}
+
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+
+		buf, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		buf = bytes.Replace(buf, []byte("LXC_NAME"), []byte(name), -1)
+		if err := ioutil.WriteFile(p, buf, fi.Mode()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
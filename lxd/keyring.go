@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/lxc/lxd"
+)
+
+/*
+ * The gpg keys we trust to sign images. Images from image servers, whether
+ * we download them or a client relays them to us, are only used if all
+ * their files come with a valid signature from one of these keys, unless
+ * the user marked the image server insecure. Keys are added with e.g.:
+ *
+ *   gpg --no-default-keyring --keyring $LXD_DIR/trusted-keys.gpg --import key.asc
+ */
+func trustedKeysPath() string {
+	return lxd.VarPath("trusted-keys.gpg")
+}
+
+func haveTrustedKeys() (bool, error) {
+	_, err := os.Stat(trustedKeysPath())
+	if err == nil {
+		return true, nil
+	} else if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	return false, err
+}
+
+/*
+ * Check file against its detached signature, file.asc.
+ */
+func verifySignature(file string) error {
+	name := path.Base(file)
+
+	if _, err := os.Stat(file + ".asc"); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%s isn't signed", name)
+		}
+		return err
+	}
+
+	output, err := exec.Command("gpgv", "--keyring", trustedKeysPath(), file+".asc", file).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("bad signature for %s: %s", name, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+/*
+ * Check all the files of an image downloaded into dir, and return whether
+ * they were all verified. Images from insecure image servers may go
+ * unsigned, or unchecked if we have no trusted keys, but bad signatures
+ * are never accepted.
+ */
+func verifyImage(dir string, insecure bool) (bool, error) {
+	verify, err := haveTrustedKeys()
+	if err != nil {
+		return false, err
+	}
+
+	if !verify {
+		if insecure {
+			return false, nil
+		}
+		return false, fmt.Errorf("refusing image: no trusted keys in %s to verify it with", trustedKeysPath())
+	}
+
+	verified := true
+	for _, file := range lxd.ImageFiles {
+		p := path.Join(dir, file)
+		if _, err := os.Stat(p + ".asc"); os.IsNotExist(err) && insecure {
+			verified = false
+			continue
+		}
+
+		if err := verifySignature(p); err != nil {
+			return false, fmt.Errorf("refusing image: %s", err)
+		}
+	}
+
+	return verified, nil
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/lxc/lxd"
 	"github.com/lxc/lxd/internal/gnuflag"
@@ -21,6 +22,8 @@ func main() {
 var verbose = gnuflag.Bool("v", false, "Enables verbose mode.")
 var debug = gnuflag.Bool("debug", false, "Enables debug mode.")
 var listenAddr = gnuflag.String("tcp", "", "TCP address <addr:port> to listen on in addition to the unix socket (e.g., 127.0.0.1:8443)")
+var imageCacheAge = gnuflag.Duration("image-cache-age", 10*24*time.Hour, "How long cached images are kept when unused (0 to keep them until they expire)")
+var snapshotInterval = gnuflag.Duration("snapshot-interval", time.Minute, "How often to look for scheduled snapshots to take and expired ones to delete")
 
 func run() error {
 	gnuflag.Usage = func() {
@@ -35,7 +38,11 @@ func run() error {
 		lxd.SetDebug(*debug)
 	}
 
-	d, err := StartDaemon(*listenAddr)
+	if *snapshotInterval <= 0 {
+		return fmt.Errorf("the snapshot interval must be positive, not %s", *snapshotInterval)
+	}
+
+	d, err := StartDaemon(*listenAddr, *imageCacheAge, *snapshotInterval)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,1343 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lxc/lxd"
+	"gopkg.in/lxc/go-lxc.v2"
+)
+
+/*
+ * Containers are moved between daemons by having the target pull them from
+ * the source. The client first asks the source to get the container ready
+ * (POST /1.0/containers/<name> with "migration" set), which hands out a
+ * secret along with the source's certificate and address. The client
+ * passes those on to the target as a "migration" container source, and the
+ * target then talks to the source over TLS, checking its certificate
+ * against the one it was given:
+ *
+ *   GET  /1.0/containers/<name>/migration?secret=<secret>&phase=<phase>
+ *        the container, or part of it, as a tarball
+ *   POST /1.0/containers/<name>/migration
+ *        {"secret": <secret>, "error": <why it failed, if it did>}
+ *
+ * The source only deletes the container once the target has reported that
+ * it created it, so that a failed migration leaves it where it was.
+ *
+ * The "filesystem" phase (the default) sends migration.json (a
+ * migrationHeader), the container's lxc config and rootfs, and its
+ * snapshots under snapshots/<name>/. Rootfs ownership is as seen from
+ * inside the container, so that the target can shift it into its own
+ * idmap. That is all there is to stopped containers.
+ *
+ * Running containers are migrated live: the filesystem is pre-copied while
+ * the container keeps running, then the "delta" phase checkpoints the
+ * container and sends what changed in its rootfs since, as a layer like
+ * those of OCI images (changed entries, and whiteouts for removed ones),
+ * and the "state" phase sends the checkpoint for the target to restore
+ * the container from. Should the migration fail once the container is
+ * checkpointed, the source restores it from the checkpoint itself, so that
+ * it keeps running there.
+ *
+ * Containers, or snapshots, are copied between daemons the same way, with
+ * "copy" set in the request to the source: the target is sent the
+ * snapshot, or the container along with its snapshots if asked for, in the
+ * "filesystem" phase, and the source keeps it all, even if the container
+ * is running.
+ *
+ * The source's operation reports the phase the migration is in: waiting,
+ * filesystem, checkpoint, delta, state and then finishing, while the target
+ * sets the container up.
+ */
+
+/*
+ * How long the source waits for the target to get back to it between two
+ * phases of the migration.
+ */
+const migrationTimeout = 5 * time.Minute
+
+type migrationHeader struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+/*
+ * A container waiting to be pulled by a target.
+ */
+type migrationSource struct {
+	container string
+	secret    string
+	live      bool
+	metadata  lxd.Jmap
+	op        string
+
+	/*
+	 * Copies leave the container where it is. They are of the snapshot,
+	 * if set, or of the container, with its snapshots if asked for.
+	 */
+	copy      bool
+	snapshot  string
+	snapshots bool
+
+	/* The phase the target last asked for */
+	phase string
+
+	/* While the target is being sent something, we don't time out */
+	busy   bool
+	active time.Time
+
+	/* When the pre-copy started, and the paths it sent */
+	since time.Time
+	sent  map[string]bool
+
+	/* The container was checkpointed, and the migration is over */
+	checkpointed bool
+	over         bool
+
+	/* The target's report, or the migration failing or being cancelled */
+	result chan error
+}
+
+var migrationsLock sync.Mutex
+var migrations = map[string]*migrationSource{}
+
+func migrationSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+func findMigration(name string, secret string) *migrationSource {
+	migrationsLock.Lock()
+	defer migrationsLock.Unlock()
+
+	m, ok := migrations[secret]
+	if !ok || m.container != name {
+		return nil
+	}
+
+	return m
+}
+
+/*
+ * Where a container's checkpoint goes while it is migrated live.
+ */
+func migrationStateDir(c *lxc.Container) string {
+	return lxd.VarPath("lxc", c.Name(), "migration")
+}
+
+/*
+ * Record the outcome of the migration, unless it already has one.
+ */
+func (m *migrationSource) report(err error) {
+	select {
+	case m.result <- err:
+	default:
+	}
+}
+
+/*
+ * The operation metadata for the phase the migration is in.
+ */
+func (m *migrationSource) progress() lxd.Jmap {
+	md := lxd.Jmap{"phase": m.phase}
+	for k, v := range m.metadata {
+		md[k] = v
+	}
+
+	return md
+}
+
+/*
+ * Move the migration from one phase to the next, if that's the phase it
+ * is in, and tell whoever is watching the operation.
+ */
+func (m *migrationSource) advance(from string, to string) bool {
+	migrationsLock.Lock()
+	if m.phase != from || m.over {
+		migrationsLock.Unlock()
+		return false
+	}
+
+	m.phase = to
+	m.busy = true
+	m.active = time.Now()
+	md := m.progress()
+	op := m.op
+	migrationsLock.Unlock()
+
+	if op != "" {
+		if err := UpdateOperationMetadata(op, md); err != nil {
+			lxd.Debugf("failed updating the migration of %s: %s", m.container, err)
+		}
+	}
+
+	return true
+}
+
+/*
+ * The target got what it asked for, or didn't.
+ */
+func (m *migrationSource) served(err error) {
+	migrationsLock.Lock()
+	m.busy = false
+	m.active = time.Now()
+	migrationsLock.Unlock()
+
+	if err != nil {
+		m.report(err)
+	}
+}
+
+/*
+ * Wait for the target to report back. The migration is over once this
+ * returns, and whether the container was checkpointed is set for good.
+ */
+func (m *migrationSource) wait() (bool, error) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var err error
+	for waiting := true; waiting; {
+		select {
+		case err = <-m.result:
+			waiting = false
+		case <-ticker.C:
+			migrationsLock.Lock()
+			idle := !m.busy && time.Since(m.active) > migrationTimeout
+			migrationsLock.Unlock()
+
+			if idle {
+				err = fmt.Errorf("the target stopped talking to us about %s", m.container)
+				waiting = false
+			}
+		}
+	}
+
+	migrationsLock.Lock()
+	defer migrationsLock.Unlock()
+	m.over = true
+	return m.checkpointed, err
+}
+
+/*
+ * Bring a container which was checkpointed for a migration that failed
+ * back to life, from its checkpoint if we can.
+ */
+func rollbackMigration(c *lxc.Container) error {
+	stateDir := migrationStateDir(c)
+	defer os.RemoveAll(stateDir)
+
+	if c.Running() {
+		return nil
+	}
+
+	if err := loadConfig(c); err != nil {
+		return err
+	}
+
+	err := c.Restore(lxc.RestoreOptions{Directory: stateDir, Verbose: true})
+	if err == nil {
+		return nil
+	}
+
+	lxd.Logf("failed restoring %s from its checkpoint, restarting it instead: %s", c.Name(), err)
+	return startContainer(c)
+}
+
+/*
+ * Migrations need other daemons to be able to reach us, and an idmap to
+ * shift rootfs ownership with.
+ */
+func checkMigration(d *Daemon) Response {
+	if d.tcpl == nil {
+		return BadRequest(fmt.Errorf("lxd isn't listening on the network, containers can't be migrated off it"))
+	}
+
+	if d.id_map == nil {
+		return BadRequest(fmt.Errorf("lxd's user has no subuids"))
+	}
+
+	return nil
+}
+
+/*
+ * Hand out a secret for the target to pull m's container with, along with
+ * how to reach us.
+ */
+func registerMigration(d *Daemon, m *migrationSource) error {
+	cert, err := ioutil.ReadFile(d.certf)
+	if err != nil {
+		return err
+	}
+
+	m.secret, err = migrationSecret()
+	if err != nil {
+		return err
+	}
+
+	m.metadata = lxd.Jmap{"secret": m.secret, "certificate": string(cert), "addr": d.tcpl.Addr().String(), "live": m.live}
+	m.phase = "waiting"
+	m.active = time.Now()
+	m.result = make(chan error, 1)
+
+	migrationsLock.Lock()
+	migrations[m.secret] = m
+	migrationsLock.Unlock()
+
+	return nil
+}
+
+/*
+ * The migration's operation started as id.
+ */
+func (m *migrationSource) started(id string) {
+	migrationsLock.Lock()
+	m.op = id
+	migrationsLock.Unlock()
+}
+
+/*
+ * The migration is over, its secret doesn't let anyone in any more.
+ */
+func (m *migrationSource) forget() {
+	migrationsLock.Lock()
+	delete(migrations, m.secret)
+	migrationsLock.Unlock()
+}
+
+func (m *migrationSource) cancel() error {
+	m.report(fmt.Errorf("migration cancelled"))
+	return nil
+}
+
+/*
+ * Get a container ready to be pulled by another daemon, and delete it once
+ * that daemon says it has it. Running containers are migrated live.
+ */
+func containerMigrate(d *Daemon, c *lxc.Container) Response {
+	if resp := checkMigration(d); resp != nil {
+		return resp
+	}
+
+	live := false
+	switch c.State() {
+	case lxc.STOPPED:
+	case lxc.RUNNING:
+		live = true
+	default:
+		return BadRequest(fmt.Errorf("container %s must be stopped or running to be migrated", c.Name()))
+	}
+
+	/* The source is destroyed afterwards, so its snapshots must go along. */
+	m := &migrationSource{container: c.Name(), live: live, snapshots: true}
+	if err := registerMigration(d, m); err != nil {
+		return InternalError(err)
+	}
+
+	run := func(id string) error {
+		m.started(id)
+		defer m.forget()
+
+		checkpointed, err := m.wait()
+		if err != nil {
+			if !checkpointed {
+				return err
+			}
+
+			if rollbackErr := rollbackMigration(c); rollbackErr != nil {
+				return fmt.Errorf("%s, and %s couldn't be brought back: %s", err, c.Name(), rollbackErr)
+			}
+			return err
+		}
+
+		if c.State() != lxc.STOPPED {
+			return fmt.Errorf("container %s was started while being migrated, not deleting it", c.Name())
+		}
+
+		return c.Destroy()
+	}
+
+	return AsyncResponseWithProgress(run, m.cancel, m.progress())
+}
+
+/*
+ * Get a container, or one of its snapshots, ready to be copied by another
+ * daemon. The container is left alone, running or not: its rootfs is sent
+ * as it is when the target pulls it.
+ */
+func containerMigrateCopy(d *Daemon, c *lxc.Container, snapshot string, snapshots bool) Response {
+	if resp := checkMigration(d); resp != nil {
+		return resp
+	}
+
+	m := &migrationSource{container: c.Name(), copy: true, snapshot: snapshot, snapshots: snapshots && snapshot == ""}
+	if err := registerMigration(d, m); err != nil {
+		return InternalError(err)
+	}
+
+	run := func(id string) error {
+		m.started(id)
+		defer m.forget()
+
+		_, err := m.wait()
+		return err
+	}
+
+	return AsyncResponseWithProgress(run, m.cancel, m.progress())
+}
+
+/*
+ * Add p, a file or a directory of plain files, to the tarball as name,
+ * with the ownership it has on the host.
+ */
+func tarFiles(tw *tar.Writer, p string, name string) error {
+	return filepath.Walk(p, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !fi.IsDir() && !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(p, file)
+		if err != nil {
+			return err
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+
+		hdr.Name = path.Join(name, rel)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uname = ""
+		hdr.Gname = ""
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			return nil
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
+
+/*
+ * Write the container, or its snapshot if one is given, as a migration
+ * tarball, along with the container's snapshots if asked for. include, if
+ * not nil, filters the entries of the rootfs as in tarRootfsFiltered.
+ */
+func writeMigrationTarball(w io.Writer, d *Daemon, c *lxc.Container, snapshot string, snapshots bool, include func(rel string, fi os.FileInfo) bool) error {
+	tw := tar.NewWriter(w)
+
+	name := c.Name()
+	dir := path.Join(d.lxcpath, c.Name())
+	config := c.ConfigFileName()
+	rootfs := c.ConfigItem("lxc.rootfs")[0]
+	if snapshot != "" {
+		name = snapshot
+		dir = snapshotDir(c, snapshot)
+		config = path.Join(dir, "config")
+		rootfs = snapshotRootfsDir(c, snapshot)
+	}
+
+	header, err := json.Marshal(migrationHeader{Name: name, Path: dir})
+	if err != nil {
+		return err
+	}
+
+	hdr := &tar.Header{
+		Name:     "migration.json",
+		Mode:     0644,
+		Size:     int64(len(header)),
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	if _, err := tw.Write(header); err != nil {
+		return err
+	}
+
+	if err := tarFiles(tw, config, "config"); err != nil {
+		return err
+	}
+
+	if err := tarRootfsFiltered(tw, rootfs, "rootfs", d.id_map, include); err != nil {
+		return err
+	}
+
+	if !snapshots {
+		return tw.Close()
+	}
+
+	files, err := ioutil.ReadDir(snapshotsDir(c))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+
+		name := file.Name()
+		prefix := path.Join("snapshots", name)
+
+		if err := tarFiles(tw, path.Join(snapshotDir(c, name), "config"), path.Join(prefix, "config")); err != nil {
+			return err
+		}
+
+		for _, p := range []string{snapshotMetadataPath(c, name), snapshotStateDir(c, name)} {
+			if _, err := os.Stat(p); err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return err
+			}
+
+			if err := tarFiles(tw, p, path.Join(prefix, path.Base(p))); err != nil {
+				return err
+			}
+		}
+
+		if err := tarRootfs(tw, snapshotRootfsDir(c, name), path.Join(prefix, "rootfs"), d.id_map); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+/*
+ * Write what changed in rootfs since the pre-copy began, as a layer.
+ * Whiteouts are only written for the topmost of the paths which went away.
+ */
+func writeMigrationDelta(w io.Writer, rootfs string, idmap *Idmap, since time.Time, sent map[string]bool) error {
+	tw := tar.NewWriter(w)
+
+	present := map[string]bool{}
+	changed := func(rel string, fi os.FileInfo) bool {
+		present[rel] = true
+
+		sb := fi.Sys().(*syscall.Stat_t)
+		ctime := time.Unix(int64(sb.Ctim.Sec), int64(sb.Ctim.Nsec))
+		return !ctime.Before(since)
+	}
+
+	if err := tarRootfsFiltered(tw, rootfs, "", idmap, changed); err != nil {
+		return err
+	}
+
+	for rel := range sent {
+		parent := path.Dir(rel)
+		if present[rel] || (sent[parent] && !present[parent]) {
+			continue
+		}
+
+		hdr := &tar.Header{
+			Name:     path.Join(parent, ".wh."+path.Base(rel)),
+			Mode:     0644,
+			ModTime:  time.Now(),
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+/*
+ * One phase's worth of the migration, streamed to the target.
+ */
+type migrationStream struct {
+	m     *migrationSource
+	write func(w io.Writer) error
+}
+
+func (r *migrationStream) Render(w http.ResponseWriter) error {
+	w.Header().Set("Content-Type", "application/x-tar")
+
+	err := r.write(w)
+	r.m.served(err)
+	return err
+}
+
+/*
+ * Targets aren't trusted clients, they are let in by their secret.
+ */
+func migrationPublic(d *Daemon, r *http.Request) bool {
+	return findMigration(mux.Vars(r)["name"], r.FormValue("secret")) != nil
+}
+
+func containerMigrationGet(d *Daemon, r *http.Request) Response {
+	m := findMigration(mux.Vars(r)["name"], r.FormValue("secret"))
+	if m == nil {
+		return Forbidden
+	}
+
+	c, err := lxc.NewContainer(m.container, d.lxcpath)
+	if err != nil {
+		return InternalError(err)
+	}
+
+	phase := r.FormValue("phase")
+	if phase == "" {
+		phase = "filesystem"
+	}
+
+	switch phase {
+	case "filesystem":
+		if !m.advance("waiting", "filesystem") {
+			return BadRequest(fmt.Errorf("container %s is already being pulled", m.container))
+		}
+
+		if !m.live {
+			return &migrationStream{m, func(w io.Writer) error {
+				if !m.copy && c.State() != lxc.STOPPED {
+					return fmt.Errorf("container %s was started while being migrated", c.Name())
+				}
+
+				if err := writeMigrationTarball(w, d, c, m.snapshot, m.snapshots, nil); err != nil {
+					return err
+				}
+
+				m.advance("filesystem", "finishing")
+				return nil
+			}}
+		}
+
+		m.since = time.Now().Add(-time.Second)
+		m.sent = map[string]bool{}
+		record := func(rel string, fi os.FileInfo) bool {
+			m.sent[rel] = true
+			return true
+		}
+
+		return &migrationStream{m, func(w io.Writer) error { return writeMigrationTarball(w, d, c, "", true, record) }}
+
+	case "delta":
+		if !m.live || !m.advance("filesystem", "checkpoint") {
+			return BadRequest(fmt.Errorf("the filesystem of %s must be pulled first", m.container))
+		}
+
+		stateDir := migrationStateDir(c)
+		err := os.MkdirAll(stateDir, 0700)
+		if err == nil {
+			err = c.Checkpoint(lxc.CheckpointOptions{Directory: stateDir, Stop: true, Verbose: true})
+		}
+
+		if err != nil {
+			os.RemoveAll(stateDir)
+			m.served(err)
+			return InternalError(err)
+		}
+
+		/* Don't leave the container stopped if nobody will bring it back. */
+		migrationsLock.Lock()
+		over := m.over
+		m.checkpointed = !over
+		migrationsLock.Unlock()
+
+		if over {
+			if err := rollbackMigration(c); err != nil {
+				lxd.Logf("failed bringing %s back: %s", c.Name(), err)
+			}
+			return BadRequest(fmt.Errorf("the migration of %s is over", c.Name()))
+		}
+
+		m.advance("checkpoint", "delta")
+		return &migrationStream{m, func(w io.Writer) error {
+			return writeMigrationDelta(w, c.ConfigItem("lxc.rootfs")[0], d.id_map, m.since, m.sent)
+		}}
+
+	case "state":
+		if !m.advance("delta", "state") {
+			return BadRequest(fmt.Errorf("the delta of %s must be pulled first", m.container))
+		}
+
+		return &migrationStream{m, func(w io.Writer) error {
+			tw := tar.NewWriter(w)
+			if err := tarFiles(tw, migrationStateDir(c), "migration"); err != nil {
+				return err
+			}
+
+			if err := tw.Close(); err != nil {
+				return err
+			}
+
+			m.advance("state", "finishing")
+			return nil
+		}}
+	}
+
+	return BadRequest(fmt.Errorf("unknown migration phase %s", phase))
+}
+
+func containerMigrationPost(d *Daemon, r *http.Request) Response {
+	raw := lxd.Jmap{}
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		return BadRequest(err)
+	}
+
+	secret, err := raw.GetString("secret")
+	if err != nil {
+		return BadRequest(err)
+	}
+
+	m := findMigration(mux.Vars(r)["name"], secret)
+	if m == nil {
+		return Forbidden
+	}
+
+	if msg, err := raw.GetString("error"); err == nil && msg != "" {
+		m.report(fmt.Errorf("the target failed: %s", msg))
+	} else {
+		m.report(nil)
+	}
+
+	return EmptySyncResponse
+}
+
+/*
+ * The client pushes a phase of a migration it relays to us.
+ */
+func containerMigrationPut(d *Daemon, r *http.Request) Response {
+	s := findRelayedMigration(mux.Vars(r)["name"])
+	if s == nil {
+		return NotFound
+	}
+
+	phase := r.FormValue("phase")
+	if phase == "" {
+		phase = "filesystem"
+	}
+
+	p := &migrationPush{phase: phase, body: r.Body, done: make(chan error, 1)}
+	select {
+	case s.pushes <- p:
+	case <-s.over:
+		return BadRequest(fmt.Errorf("the migration into %s is over", s.target))
+	case <-time.After(migrationTimeout):
+		return InternalError(fmt.Errorf("the migration into %s isn't waiting for anything", s.target))
+	}
+
+	if err := <-p.done; err != nil {
+		return BadRequest(err)
+	}
+
+	return EmptySyncResponse
+}
+
+/*
+ * The client gives up on a migration it relays to us.
+ */
+func containerMigrationDelete(d *Daemon, r *http.Request) Response {
+	s := findRelayedMigration(mux.Vars(r)["name"])
+	if s == nil {
+		return NotFound
+	}
+
+	select {
+	case s.aborted <- fmt.Errorf("the client gave up relaying the migration"):
+	default:
+	}
+
+	return EmptySyncResponse
+}
+
+var containerMigrationCmd = Command{"containers/{name}/migration", false, true, containerMigrationGet, containerMigrationPut, containerMigrationPost, containerMigrationDelete, migrationPublic}
+
+/*
+ * The target's side of a migration, as given by a "migration" container
+ * source: {"url": "https://<source address>", "name": <container on the
+ * source>, "secret": ..., "certificate": <PEM of the source's certificate>,
+ * "live": <whether the container is running>, "copy": <whether the source
+ * keeps it>}.
+ *
+ * Targets which can't reach the source have the client relay the migration
+ * instead, with "relay" set in place of the url, name, secret and
+ * certificate. The client then pulls each phase from the source and pushes
+ * it to us:
+ *
+ *   PUT    /1.0/containers/<name>/migration?phase=<phase>
+ *          the phase's tarball, as the source sent it
+ *   DELETE /1.0/containers/<name>/migration
+ *          the client gave up
+ *
+ * and tells the source how it went itself.
+ */
+type migrationSink struct {
+	url    string
+	name   string
+	secret string
+	live   bool
+	copy   bool
+	cert   *x509.Certificate
+	tls    *tls.Config
+	http   http.Client
+
+	/* Relayed migrations: the phases the client pushes, and when to stop */
+	relay   bool
+	target  string
+	pushes  chan *migrationPush
+	aborted chan error
+	over    chan bool
+}
+
+/*
+ * A phase of a relayed migration, pushed by the client. Whoever pulled it
+ * closes it once done reading, which answers the client's request.
+ */
+type migrationPush struct {
+	phase string
+	body  io.Reader
+	done  chan error
+}
+
+func (p *migrationPush) Read(buf []byte) (int, error) {
+	return p.body.Read(buf)
+}
+
+func (p *migrationPush) Close() error {
+	p.finish(nil)
+	return nil
+}
+
+func (p *migrationPush) finish(err error) {
+	select {
+	case p.done <- err:
+	default:
+	}
+}
+
+/* The relayed migrations we are the target of, by container name */
+var relayedMigrations = map[string]*migrationSink{}
+
+func findRelayedMigration(name string) *migrationSink {
+	migrationsLock.Lock()
+	defer migrationsLock.Unlock()
+
+	return relayedMigrations[name]
+}
+
+func newMigrationSink(d *Daemon, source lxd.Jmap) (*migrationSink, error) {
+	s := &migrationSink{}
+
+	if live, err := source.GetBool("live"); err == nil {
+		s.live = live
+	}
+
+	if copying, err := source.GetBool("copy"); err == nil {
+		s.copy = copying
+	}
+
+	if relay, err := source.GetBool("relay"); err == nil && relay {
+		s.relay = true
+		s.pushes = make(chan *migrationPush)
+		s.aborted = make(chan error, 1)
+		s.over = make(chan bool)
+		return s, nil
+	}
+
+	var err error
+	s.url, err = source.GetString("url")
+	if err != nil {
+		return nil, err
+	}
+
+	s.name, err = source.GetString("name")
+	if err != nil {
+		return nil, err
+	}
+
+	s.secret, err = source.GetString("secret")
+	if err != nil {
+		return nil, err
+	}
+
+	rawCert, err := source.GetString("certificate")
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode([]byte(rawCert))
+	if block == nil {
+		return nil, fmt.Errorf("bad source certificate")
+	}
+
+	s.cert, err = x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	/* We present our own certificate, like the source does to us. */
+	mycert, err := tls.LoadX509KeyPair(d.certf, d.keyf)
+	if err != nil {
+		return nil, err
+	}
+
+	s.tls = &tls.Config{InsecureSkipVerify: true,
+		Certificates: []tls.Certificate{mycert},
+		MinVersion:   tls.VersionTLS12,
+		MaxVersion:   tls.VersionTLS12}
+	s.http.Transport = &http.Transport{DialTLS: s.dial}
+
+	return s, nil
+}
+
+/*
+ * Wait for the client to relay the migration into the container name.
+ */
+func (s *migrationSink) expect(name string) error {
+	migrationsLock.Lock()
+	defer migrationsLock.Unlock()
+
+	if _, ok := relayedMigrations[name]; ok {
+		return fmt.Errorf("container %s is already being relayed", name)
+	}
+
+	s.target = name
+	relayedMigrations[name] = s
+	return nil
+}
+
+/*
+ * The relayed migration is over, pushes aren't waited for any more.
+ */
+func (s *migrationSink) forget() {
+	migrationsLock.Lock()
+	delete(relayedMigrations, s.target)
+	migrationsLock.Unlock()
+
+	close(s.over)
+}
+
+/*
+ * Connect to the source, making sure it is the one we were told about
+ * before the secret goes anywhere.
+ */
+func (s *migrationSink) dial(network string, addr string) (net.Conn, error) {
+	conn, err := tls.Dial(network, addr, s.tls)
+	if err != nil {
+		return nil, err
+	}
+
+	peers := conn.ConnectionState().PeerCertificates
+	if len(peers) == 0 || !bytes.Equal(peers[0].Raw, s.cert.Raw) {
+		conn.Close()
+		return nil, fmt.Errorf("%s isn't the migration source, its certificate doesn't match", addr)
+	}
+
+	return conn, nil
+}
+
+func (s *migrationSink) migrationURL() string {
+	return fmt.Sprintf("%s/%s/containers/%s/migration", strings.TrimSuffix(s.url, "/"), lxd.APIVersion, s.name)
+}
+
+/*
+ * Get one phase of the migration from the source.
+ */
+func (s *migrationSink) pull(phase string) (io.ReadCloser, error) {
+	if s.relay {
+		return s.pulled(phase)
+	}
+
+	query := url.Values{"secret": []string{s.secret}, "phase": []string{phase}}
+	raw, err := s.http.Get(s.migrationURL() + "?" + query.Encode())
+	if err != nil {
+		/* So that the client knows to relay the container instead */
+		return nil, fmt.Errorf("%s: %s", lxd.SourceUnreachable, err)
+	}
+
+	if raw.StatusCode != 200 {
+		resp, err := lxd.ParseResponse(raw)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := lxd.ParseError(resp); err != nil {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("unexpected response from the source")
+	}
+
+	return raw.Body, nil
+}
+
+/*
+ * Get one phase of a relayed migration, as the client pushes it.
+ */
+func (s *migrationSink) pulled(phase string) (io.ReadCloser, error) {
+	select {
+	case p := <-s.pushes:
+		if p.phase != phase {
+			err := fmt.Errorf("expected the %s phase, got %s", phase, p.phase)
+			p.finish(err)
+			return nil, err
+		}
+		return p, nil
+	case err := <-s.aborted:
+		return nil, err
+	case <-time.After(migrationTimeout):
+		return nil, fmt.Errorf("the client stopped relaying the migration")
+	}
+}
+
+/*
+ * Pull the container from the source into c, and if it is running, what
+ * changed in it since along with its checkpoint.
+ */
+func (s *migrationSink) receive(d *Daemon, c *lxc.Container) error {
+	body, err := s.pull("filesystem")
+	if err != nil {
+		return err
+	}
+
+	err = receiveContainer(d, c, body)
+	body.Close()
+	if err != nil {
+		return err
+	}
+
+	if s.copy {
+		if err := freshCopyConfig(d, c); err != nil {
+			os.RemoveAll(path.Join(d.lxcpath, c.Name()))
+			return err
+		}
+		return nil
+	}
+
+	if !s.live {
+		return nil
+	}
+
+	if err := s.receiveState(d, c); err != nil {
+		os.RemoveAll(path.Join(d.lxcpath, c.Name()))
+		return err
+	}
+
+	return nil
+}
+
+/*
+ * Like local copies, copies from other daemons start from a fresh lxc
+ * config, keeping only the includes of the one they came with, so that
+ * they get their own hostname and MAC addresses. Their snapshots share
+ * the copy's, like those we take.
+ */
+func freshCopyConfig(d *Daemon, c *lxc.Container) error {
+	includes, err := lxcIncludes(c)
+	if err != nil {
+		return err
+	}
+
+	c.ClearConfig()
+	if err := loadDefaultConfig(c); err != nil {
+		return err
+	}
+
+	for _, include := range includes {
+		if err := c.SetConfigItem("lxc.include", include); err != nil {
+			return err
+		}
+	}
+
+	if err := c.SetConfigItem("lxc.rootfs", path.Join(d.lxcpath, c.Name(), "rootfs")); err != nil {
+		return err
+	}
+
+	if err := c.SetConfigItem("lxc.utsname", c.Name()); err != nil {
+		return err
+	}
+
+	if err := setIdmap(c, d.id_map); err != nil {
+		return err
+	}
+
+	if err := c.SaveConfigFile(c.ConfigFileName()); err != nil {
+		return err
+	}
+
+	snapshots, err := ioutil.ReadDir(snapshotsDir(c))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, snapshot := range snapshots {
+		if !snapshot.IsDir() {
+			continue
+		}
+
+		sc, err := lxc.NewContainer(snapshot.Name(), snapshotsDir(c))
+		if err != nil {
+			return err
+		}
+
+		sc.ClearConfig()
+		if err := sc.LoadConfigFile(c.ConfigFileName()); err != nil {
+			return err
+		}
+
+		if err := sc.SetConfigItem("lxc.rootfs", snapshotRootfsDir(c, snapshot.Name())); err != nil {
+			return err
+		}
+
+		if err := sc.SetConfigItem("lxc.utsname", snapshot.Name()); err != nil {
+			return err
+		}
+
+		if err := sc.SaveConfigFile(sc.ConfigFileName()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+ * Bring the pre-copied rootfs up to date, and unpack the checkpoint.
+ */
+func (s *migrationSink) receiveState(d *Daemon, c *lxc.Container) error {
+	dir := path.Join(d.lxcpath, c.Name())
+
+	delta, err := s.pull("delta")
+	if err != nil {
+		return err
+	}
+	defer delta.Close()
+
+	f, err := ioutil.TempFile(dir, "delta_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = io.Copy(f, delta)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	if err := unpackLayer(f.Name(), path.Join(dir, "rootfs"), d.id_map); err != nil {
+		return err
+	}
+
+	state, err := s.pull("state")
+	if err != nil {
+		return err
+	}
+	defer state.Close()
+
+	cmd := exec.Command("tar", "-C", dir, "--numeric-owner", "-xpf", "-")
+	cmd.Stdin = state
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed unpacking checkpoint: %s: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+/*
+ * Once the container is set up, bring it back to life from its checkpoint
+ * if it was running, and tell the source how it all went.
+ */
+func (s *migrationSink) finish(d *Daemon, c *lxc.Container, err error) error {
+	if s.relay {
+		s.forget()
+	}
+
+	if err == nil && s.live {
+		stateDir := migrationStateDir(c)
+		err = c.Restore(lxc.RestoreOptions{Directory: stateDir, Verbose: true})
+		os.RemoveAll(stateDir)
+
+		/* The source brings it back to life instead. */
+		if err != nil {
+			if c.Running() {
+				c.Stop()
+			}
+			os.RemoveAll(path.Join(d.lxcpath, c.Name()))
+		}
+	}
+
+	if reportErr := s.report(err); err == nil {
+		return reportErr
+	}
+
+	return err
+}
+
+/*
+ * Tell the source how the migration went.
+ */
+func (s *migrationSink) report(result error) error {
+	/* The client tells the source for relayed migrations. */
+	if s.relay {
+		return nil
+	}
+
+	body := lxd.Jmap{"secret": s.secret}
+	if result != nil {
+		body["error"] = result.Error()
+	}
+
+	buf := bytes.Buffer{}
+	if err := json.NewEncoder(&buf).Encode(body); err != nil {
+		return err
+	}
+
+	raw, err := s.http.Post(s.migrationURL(), "application/json", &buf)
+	if err != nil {
+		return err
+	}
+
+	resp, err := lxd.ParseResponse(raw)
+	if err != nil {
+		return err
+	}
+
+	return lxd.ParseError(resp)
+}
+
+/*
+ * Unpack a migration tarball into c's directory, shift its rootfs and those
+ * of its snapshots into our idmap, point their configs at where they now
+ * live and load the container's config. The config is saved by the caller.
+ */
+func receiveContainer(d *Daemon, c *lxc.Container, r io.Reader) error {
+	dir := path.Join(d.lxcpath, c.Name())
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("container %s already exists", c.Name())
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	err := func() error {
+		args := append([]string{"-C", dir, "--numeric-owner"}, idXattrTarFlags...)
+		cmd := exec.Command("tar", append(args, "-xpf", "-")...)
+		cmd.Stdin = r
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed unpacking container: %s: %s", err, strings.TrimSpace(string(output)))
+		}
+
+		header := migrationHeader{}
+		if err := readJson(path.Join(dir, "migration.json"), &header); err != nil {
+			return err
+		}
+		os.Remove(path.Join(dir, "migration.json"))
+
+		snapshots, err := ioutil.ReadDir(snapshotsDir(c))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		dirs := []string{dir}
+		for _, snapshot := range snapshots {
+			if snapshot.IsDir() {
+				dirs = append(dirs, snapshotDir(c, snapshot.Name()))
+			}
+		}
+
+		for _, p := range dirs {
+			if err := d.id_map.ShiftRootfs(path.Join(p, "rootfs")); err != nil {
+				return err
+			}
+
+			if err := rewriteConfigPaths(path.Join(p, "config"), header.Path, dir); err != nil {
+				return err
+			}
+		}
+
+		for _, snapshot := range dirs[1:] {
+			sc, err := lxc.NewContainer(path.Base(snapshot), snapshotsDir(c))
+			if err != nil {
+				return err
+			}
+
+			if err := setIdmap(sc, d.id_map); err != nil {
+				return err
+			}
+
+			if err := sc.SaveConfigFile(sc.ConfigFileName()); err != nil {
+				return err
+			}
+		}
+
+		c.ClearConfig()
+		if err := c.LoadConfigFile(c.ConfigFileName()); err != nil {
+			return err
+		}
+
+		if err := setIdmap(c, d.id_map); err != nil {
+			return err
+		}
+
+		hostname := c.ConfigItem("lxc.utsname")
+		if len(hostname) == 0 || hostname[0] != header.Name {
+			return nil
+		}
+
+		return c.SetConfigItem("lxc.utsname", c.Name())
+	}()
+
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	return nil
+}
@@ -31,7 +31,7 @@ func networksGet(d *Daemon, r *http.Request) Response {
 	return SyncResponse(true, result)
 }
 
-var networksCmd = Command{"networks", false, false, networksGet, nil, nil, nil}
+var networksCmd = Command{"networks", false, false, networksGet, nil, nil, nil, nil}
 
 type network struct {
 	Name    string   `json:"name"`
@@ -116,4 +116,4 @@ func networkGet(d *Daemon, r *http.Request) Response {
 	return SyncResponse(true, &n)
 }
 
-var networkCmd = Command{"networks/{name}", false, false, networkGet, nil, nil, nil}
+var networkCmd = Command{"networks/{name}", false, false, networkGet, nil, nil, nil, nil}
@@ -0,0 +1,612 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lxc/lxd"
+)
+
+/*
+ * Application images, in the OCI image layout or as written by "docker save",
+ * are a set of layer tarballs plus a json config. We import them as regular
+ * images by unpacking the layers on top of each other into a rootfs, and
+ * keep their config in the image's metadata.
+ */
+
+/*
+ * The parts of an OCI (or docker) image config we care about.
+ */
+type ociImageConfig struct {
+	Hostname   string   `json:"Hostname,omitempty" yaml:"hostname,omitempty"`
+	Env        []string `json:"Env,omitempty" yaml:"env,omitempty"`
+	Entrypoint []string `json:"Entrypoint,omitempty" yaml:"entrypoint,omitempty"`
+	Cmd        []string `json:"Cmd,omitempty" yaml:"cmd,omitempty"`
+	WorkingDir string   `json:"WorkingDir,omitempty" yaml:"working_dir,omitempty"`
+}
+
+type ociRootfs struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+type ociImage struct {
+	Created      string         `json:"created,omitempty"`
+	Architecture string         `json:"architecture"`
+	OS           string         `json:"os"`
+	Config       ociImageConfig `json:"config"`
+	Rootfs       ociRootfs      `json:"rootfs"`
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+/* A layer blob, and the digest the image says it has */
+type ociLayer struct {
+	path   string
+	digest string
+}
+
+/* One entry of a "docker save" manifest.json */
+type dockerManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+const ociRefName = "org.opencontainers.image.ref.name"
+
+var ociDigestRegexp = regexp.MustCompile("^sha256:[0-9a-f]{64}$")
+
+/*
+ * Open a tarball which may or may not be gzip compressed.
+ */
+func openTarball(tarball string) (*os.File, *tar.Reader, error) {
+	f, err := os.Open(tarball)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	br := bufio.NewReader(f)
+	magic, err := br.Peek(2)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	if magic[0] != 0x1f || magic[1] != 0x8b {
+		return f, tar.NewReader(br), nil
+	}
+
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return f, tar.NewReader(gz), nil
+}
+
+/*
+ * Tell lxd images ("lxd") from OCI image layouts ("oci"), "docker save"
+ * tarballs ("docker") and images relayed from an image server
+ * ("lxc-images").
+ */
+func imageTarballFormat(tarball string) (string, error) {
+	f, tr, err := openTarball(tarball)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+
+		switch path.Clean(hdr.Name) {
+		case "metadata.yaml":
+			return "lxd", nil
+		case "oci-layout":
+			return "oci", nil
+		case "manifest.json":
+			return "docker", nil
+		case "meta.tar.xz":
+			return "lxc-images", nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown image format")
+}
+
+func ociBlobPath(dir string, digest string) (string, error) {
+	if !ociDigestRegexp.MatchString(digest) {
+		return "", fmt.Errorf("unsupported digest %s", digest)
+	}
+
+	return path.Join(dir, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:")), nil
+}
+
+func readJson(p string, v interface{}) error {
+	buf, err := ioutil.ReadFile(p)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(buf, v)
+}
+
+/*
+ * Find the layers and config of the (first) image in an unpacked OCI image
+ * layout.
+ */
+func readOCILayout(dir string) ([]ociLayer, *ociImage, string, error) {
+	index := ociIndex{}
+	if err := readJson(path.Join(dir, "index.json"), &index); err != nil {
+		return nil, nil, "", err
+	}
+
+	if len(index.Manifests) == 0 {
+		return nil, nil, "", fmt.Errorf("no image in the OCI layout")
+	}
+
+	p, err := ociBlobPath(dir, index.Manifests[0].Digest)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	manifest := ociManifest{}
+	if err := readJson(p, &manifest); err != nil {
+		return nil, nil, "", err
+	}
+
+	p, err = ociBlobPath(dir, manifest.Config.Digest)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	config := ociImage{}
+	if err := readJson(p, &config); err != nil {
+		return nil, nil, "", err
+	}
+
+	layers := []ociLayer{}
+	for _, layer := range manifest.Layers {
+		if strings.Contains(layer.MediaType, "zstd") {
+			return nil, nil, "", fmt.Errorf("unsupported layer type %s", layer.MediaType)
+		}
+
+		p, err := ociBlobPath(dir, layer.Digest)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		layers = append(layers, ociLayer{p, layer.Digest})
+	}
+
+	return layers, &config, index.Manifests[0].Annotations[ociRefName], nil
+}
+
+/*
+ * Same thing for an unpacked "docker save" tarball, whose layers are the
+ * uncompressed tarballs the diff ids of the config are the digests of.
+ */
+func readDockerArchive(dir string) ([]ociLayer, *ociImage, string, error) {
+	manifests := []dockerManifest{}
+	if err := readJson(path.Join(dir, "manifest.json"), &manifests); err != nil {
+		return nil, nil, "", err
+	}
+
+	if len(manifests) == 0 {
+		return nil, nil, "", fmt.Errorf("no image in the docker archive")
+	}
+	manifest := manifests[0]
+
+	config := ociImage{}
+	if err := readJson(path.Join(dir, path.Clean("/"+manifest.Config)), &config); err != nil {
+		return nil, nil, "", err
+	}
+
+	if len(config.Rootfs.DiffIDs) != len(manifest.Layers) {
+		return nil, nil, "", fmt.Errorf("the docker archive has %d layers but %d diff ids", len(manifest.Layers), len(config.Rootfs.DiffIDs))
+	}
+
+	layers := []ociLayer{}
+	for i, layer := range manifest.Layers {
+		digest := config.Rootfs.DiffIDs[i]
+		if !ociDigestRegexp.MatchString(digest) {
+			return nil, nil, "", fmt.Errorf("unsupported digest %s", digest)
+		}
+		layers = append(layers, ociLayer{path.Join(dir, path.Clean("/"+layer)), digest})
+	}
+
+	name := ""
+	if len(manifest.RepoTags) > 0 {
+		name = manifest.RepoTags[0]
+	}
+
+	return layers, &config, name, nil
+}
+
+/*
+ * The host path of a layer entry, creating any missing parent directory
+ * (owned by the container's root) on the way. Layers may not write through
+ * symlinks, which could otherwise point anywhere on the host.
+ */
+func layerPath(rootfs string, name string, idmap *Idmap) (string, error) {
+	p := rootfs
+	fields := strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/")
+	for i, field := range fields {
+		if field == "" {
+			continue
+		}
+
+		p = path.Join(p, field)
+		if i == len(fields)-1 {
+			break
+		}
+
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			if err := os.Mkdir(p, 0755); err != nil {
+				return "", err
+			}
+
+			if err := os.Lchown(p, int(idmap.Uidmin), int(idmap.Gidmin)); err != nil {
+				return "", err
+			}
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("layer entry %s goes through a symlink", name)
+		}
+
+		if !fi.IsDir() {
+			return "", fmt.Errorf("layer entry %s goes through a file", name)
+		}
+	}
+
+	return p, nil
+}
+
+/*
+ * Check that a layer blob has the digest the image says it has, before any
+ * of it is unpacked.
+ */
+func verifyLayer(layer ociLayer) error {
+	f, err := os.Open(layer.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+
+	if digest := fmt.Sprintf("sha256:%x", h.Sum(nil)); digest != layer.digest {
+		return fmt.Errorf("its digest is %s rather than %s", digest, layer.digest)
+	}
+
+	return nil
+}
+
+/*
+ * Apply the whiteouts of a layer, which remove files from the layers below.
+ */
+func applyWhiteouts(layer string, rootfs string, idmap *Idmap) error {
+	f, tr, err := openTarball(layer)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		dir, base := path.Split(path.Clean("/" + hdr.Name))
+		if !strings.HasPrefix(base, ".wh.") {
+			continue
+		}
+
+		if base == ".wh..wh..opq" {
+			/* An opaque directory hides everything below it */
+			p, err := layerPath(rootfs, path.Join(dir, "x"), idmap)
+			if err != nil {
+				return err
+			}
+
+			entries, err := ioutil.ReadDir(path.Dir(p))
+			if err != nil {
+				return err
+			}
+
+			for _, entry := range entries {
+				if err := os.RemoveAll(path.Join(path.Dir(p), entry.Name())); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		p, err := layerPath(rootfs, path.Join(dir, strings.TrimPrefix(base, ".wh.")), idmap)
+		if err != nil {
+			return err
+		}
+
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+	}
+}
+
+/*
+ * Unpack a layer on top of rootfs, shifting ownership into idmap.
+ */
+func unpackLayer(layer string, rootfs string, idmap *Idmap) error {
+	if err := applyWhiteouts(layer, rootfs, idmap); err != nil {
+		return err
+	}
+
+	f, tr, err := openTarball(layer)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if strings.HasPrefix(path.Base(hdr.Name), ".wh.") || path.Clean("/"+hdr.Name) == "/" {
+			continue
+		}
+
+		if uint(hdr.Uid) >= idmap.Uidrange || uint(hdr.Gid) >= idmap.Gidrange {
+			return fmt.Errorf("%s is owned by %d:%d, outside of the idmap", hdr.Name, hdr.Uid, hdr.Gid)
+		}
+
+		p, err := layerPath(rootfs, hdr.Name, idmap)
+		if err != nil {
+			return err
+		}
+
+		/* Whatever was there in a lower layer is replaced, except directories */
+		fi, err := os.Lstat(p)
+		if err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(p); err != nil {
+				return err
+			}
+		}
+
+		mode := hdr.FileInfo().Mode()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.Mkdir(p, 0755); err != nil && !os.IsExist(err) {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			out, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				return err
+			}
+
+			_, err = io.Copy(out, tr)
+			out.Close()
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, p); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			target, err := layerPath(rootfs, hdr.Linkname, idmap)
+			if err != nil {
+				return err
+			}
+
+			if err := os.Link(target, p); err != nil {
+				return err
+			}
+		case tar.TypeFifo:
+			if err := syscall.Mkfifo(p, 0600); err != nil {
+				return err
+			}
+		default:
+			/* Device nodes are set up by lxc when the container starts */
+			lxd.Debugf("skipping %s of type %c", hdr.Name, hdr.Typeflag)
+			continue
+		}
+
+		if err := os.Lchown(p, int(idmap.Uidmin)+hdr.Uid, int(idmap.Gidmin)+hdr.Gid); err != nil {
+			return err
+		}
+
+		if hdr.Typeflag == tar.TypeSymlink || hdr.Typeflag == tar.TypeLink {
+			continue
+		}
+
+		/* chown drops the setuid and setgid bits, and file capabilities. */
+		if err := os.Chmod(p, mode); err != nil {
+			return err
+		}
+
+		if err := setLayerXattrs(p, hdr, idmap); err != nil {
+			return err
+		}
+	}
+}
+
+/*
+ * Set the extended attributes holding ids which came with a layer entry,
+ * shifted into our idmap. Others are left out, like tar does by default.
+ */
+func setLayerXattrs(p string, hdr *tar.Header, idmap *Idmap) error {
+	for _, name := range []string{aclAccessXattr, aclDefaultXattr, capsXattr} {
+		value, ok := hdr.Xattrs[name]
+		if !ok {
+			continue
+		}
+
+		shifted, err := shiftXattr(name, []byte(value), idmap.containerView(), idmap)
+		if err != nil {
+			return fmt.Errorf("%s: %s: %s", hdr.Name, name, err)
+		}
+
+		if err := hostShiftOps.setxattr(p, name, shifted); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+ * The image metadata of an application image: its environment, command and
+ * working directory become the containers' config, and the rest of its
+ * config is kept along.
+ */
+func ociImageMetadata(config *ociImage, name string) *imageMetadata {
+	arch, ok := imageArchs[config.Architecture]
+	if !ok {
+		arch = config.Architecture
+	}
+
+	created := time.Now().Unix()
+	if t, err := time.Parse(time.RFC3339Nano, config.Created); err == nil {
+		created = t.Unix()
+	}
+
+	if name == "" {
+		name = "application image"
+	}
+
+	meta := imageMetadata{
+		Architecture: arch,
+		CreationDate: created,
+		Properties:   map[string]string{"description": name},
+		Config:       []lxd.Jmap{},
+		OCI:          &config.Config,
+	}
+
+	for _, env := range config.Config.Env {
+		meta.Config = append(meta.Config, lxd.Jmap{"key": "lxc.environment", "value": env})
+	}
+
+	command := append(config.Config.Entrypoint, config.Config.Cmd...)
+	if len(command) > 0 {
+		meta.Config = append(meta.Config, lxd.Jmap{"key": "lxc.init_cmd", "value": strings.Join(command, " ")})
+	}
+
+	if config.Config.WorkingDir != "" {
+		meta.Config = append(meta.Config, lxd.Jmap{"key": "lxc.init_cwd", "value": config.Config.WorkingDir})
+	}
+
+	return &meta
+}
+
+/*
+ * Turn an OCI or docker image tarball into an image in the image store and
+ * return its fingerprint.
+ */
+func importOCIImage(d *Daemon, tarball string, format string, public bool) (string, error) {
+	if d.id_map == nil {
+		return "", fmt.Errorf("lxd's user has no subuids")
+	}
+
+	dir, err := ioutil.TempDir(imagesDir(), "oci_")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	src := path.Join(dir, "src")
+	if err := os.Mkdir(src, 0700); err != nil {
+		return "", err
+	}
+
+	output, err := exec.Command("tar", "-C", src, "-xf", tarball).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed unpacking image: %s: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	var layers []ociLayer
+	var config *ociImage
+	var name string
+	if format == "oci" {
+		layers, config, name, err = readOCILayout(src)
+	} else {
+		layers, config, name, err = readDockerArchive(src)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	rootfs := path.Join(dir, "rootfs")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		return "", err
+	}
+
+	if err := os.Lchown(rootfs, int(d.id_map.Uidmin), int(d.id_map.Gidmin)); err != nil {
+		return "", err
+	}
+
+	for _, layer := range layers {
+		if err := verifyLayer(layer); err != nil {
+			return "", fmt.Errorf("bad layer %s: %s", path.Base(layer.path), err)
+		}
+
+		lxd.Debugf("unpacking layer %s", path.Base(layer.path))
+		if err := unpackLayer(layer.path, rootfs, d.id_map); err != nil {
+			return "", fmt.Errorf("failed unpacking layer %s: %s", path.Base(layer.path), err)
+		}
+	}
+
+	return writeImage(d, rootfs, ociImageMetadata(config, name), public)
+}
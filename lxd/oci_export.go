@@ -0,0 +1,299 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lxc/lxd"
+	"gopkg.in/lxc/go-lxc.v2"
+)
+
+/*
+ * Stopped containers and snapshots can be exported as OCI image layouts, for
+ * use by other tooling. The layout has a single layer holding the rootfs,
+ * and the container's hostname and environment go into the image config.
+ */
+
+const (
+	ociLayoutMediaType   = "application/vnd.oci.image.index.v1+json"
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigMediaType   = "application/vnd.oci.image.config.v1+json"
+	ociLayerMediaType    = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+/*
+ * Write rootfs as a gzipped layer into the layout in dir. Returns the
+ * layer's descriptor and the digest of its uncompressed contents, which is
+ * what the image config refers to it by.
+ */
+func writeOCILayer(dir string, rootfs string, idmap *Idmap) (*ociDescriptor, string, error) {
+	f, err := ioutil.TempFile(dir, "layer_")
+	if err != nil {
+		return nil, "", err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	blobHash := sha256.New()
+	diffHash := sha256.New()
+	counter := &countingWriter{}
+	gz := gzip.NewWriter(io.MultiWriter(f, blobHash, counter))
+	tw := tar.NewWriter(io.MultiWriter(gz, diffHash))
+
+	err = func() error {
+		defer f.Close()
+
+		if err := tarRootfs(tw, rootfs, "", idmap); err != nil {
+			return err
+		}
+
+		if err := tw.Close(); err != nil {
+			return err
+		}
+
+		return gz.Close()
+	}()
+	if err != nil {
+		return nil, "", err
+	}
+
+	desc := ociDescriptor{
+		MediaType: ociLayerMediaType,
+		Digest:    fmt.Sprintf("sha256:%x", blobHash.Sum(nil)),
+		Size:      counter.n,
+	}
+
+	p, err := ociBlobPath(dir, desc.Digest)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := os.Rename(tmp, p); err != nil {
+		return nil, "", err
+	}
+
+	return &desc, fmt.Sprintf("sha256:%x", diffHash.Sum(nil)), nil
+}
+
+/*
+ * Write v as a json blob into the layout in dir.
+ */
+func writeOCIBlob(dir string, mediaType string, v interface{}) (*ociDescriptor, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	desc := ociDescriptor{
+		MediaType: mediaType,
+		Digest:    fmt.Sprintf("sha256:%x", sha256.Sum256(buf)),
+		Size:      int64(len(buf)),
+	}
+
+	p, err := ociBlobPath(dir, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &desc, ioutil.WriteFile(p, buf, 0644)
+}
+
+/*
+ * Write an OCI image layout of rootfs, with config as its image config,
+ * into dir.
+ */
+func writeOCILayout(dir string, rootfs string, config *ociImage, name string, idmap *Idmap) error {
+	if err := os.MkdirAll(path.Join(dir, "blobs", "sha256"), 0755); err != nil {
+		return err
+	}
+
+	layer, diffID, err := writeOCILayer(dir, rootfs, idmap)
+	if err != nil {
+		return err
+	}
+
+	config.Rootfs = ociRootfs{Type: "layers", DiffIDs: []string{diffID}}
+	configDesc, err := writeOCIBlob(dir, ociConfigMediaType, config)
+	if err != nil {
+		return err
+	}
+
+	manifest := ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		Config:        *configDesc,
+		Layers:        []ociDescriptor{*layer},
+	}
+	manifestDesc, err := writeOCIBlob(dir, ociManifestMediaType, manifest)
+	if err != nil {
+		return err
+	}
+	manifestDesc.Annotations = map[string]string{ociRefName: name}
+
+	index := ociIndex{
+		SchemaVersion: 2,
+		MediaType:     ociLayoutMediaType,
+		Manifests:     []ociDescriptor{*manifestDesc},
+	}
+
+	buf, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "index.json"), buf, 0644); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion": "1.0.0"}`), 0644)
+}
+
+/*
+ * The image config of a container: its hostname and environment, as found
+ * in its lxc config.
+ */
+func containerOCIConfig(c *lxc.Container) *ociImage {
+	config := ociImage{
+		Created:      time.Now().UTC().Format(time.RFC3339),
+		Architecture: runtime.GOARCH,
+		OS:           "linux",
+	}
+
+	if hostname := c.ConfigItem("lxc.utsname"); len(hostname) > 0 {
+		config.Config.Hostname = hostname[0]
+	}
+
+	for _, env := range c.ConfigItem("lxc.environment") {
+		if env != "" {
+			config.Config.Env = append(config.Config.Env, env)
+		}
+	}
+
+	return &config
+}
+
+type containerExport struct {
+	name string
+	dir  string
+}
+
+/*
+ * Stream the layout as an uncompressed tarball, and get rid of it.
+ */
+func (r *containerExport) Render(w http.ResponseWriter) error {
+	defer os.RemoveAll(r.dir)
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.tar", r.name))
+
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(r.dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(r.dir, p)
+		if err != nil {
+			return err
+		}
+
+		hdr := &tar.Header{
+			Name:     rel,
+			Mode:     0644,
+			Size:     fi.Size(),
+			ModTime:  fi.ModTime(),
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+/*
+ * Export a stopped container, or one of its snapshots, as an OCI image
+ * layout. The layout is written out before we answer, so that failures
+ * are reported as such rather than as a truncated tarball.
+ */
+func containerExportGet(d *Daemon, r *http.Request) Response {
+	if d.id_map == nil {
+		return BadRequest(fmt.Errorf("lxd's user has no subuids"))
+	}
+
+	name := mux.Vars(r)["name"]
+	c, err := lxc.NewContainer(name, d.lxcpath)
+	if err != nil {
+		return InternalError(err)
+	}
+
+	if !c.Defined() {
+		return NotFound
+	}
+
+	var rootfs string
+	source := c
+	snapshotName := mux.Vars(r)["snapshotName"]
+	if snapshotName != "" {
+		rootfs = snapshotRootfsDir(c, snapshotName)
+		if _, err := os.Stat(rootfs); err != nil {
+			return SmartError(err)
+		}
+
+		source, err = lxc.NewContainer(snapshotName, snapshotsDir(c))
+		if err != nil {
+			return InternalError(err)
+		}
+		name = name + "-" + snapshotName
+	} else {
+		if c.State() != lxc.STOPPED {
+			return BadRequest(fmt.Errorf("container %s must be stopped to be exported", name))
+		}
+		rootfs = c.ConfigItem("lxc.rootfs")[0]
+	}
+
+	dir, err := ioutil.TempDir(lxd.VarPath(), "export_")
+	if err != nil {
+		return InternalError(err)
+	}
+
+	if err := writeOCILayout(dir, rootfs, containerOCIConfig(source), name, d.id_map); err != nil {
+		os.RemoveAll(dir)
+		return InternalError(err)
+	}
+
+	return &containerExport{name, dir}
+}
+
+var containerExportCmd = Command{"containers/{name}/export", false, false, containerExportGet, nil, nil, nil, nil}
+
+var snapshotExportCmd = Command{"containers/{name}/snapshots/{snapshotName}/export", false, false, containerExportGet, nil, nil, nil, nil}
@@ -66,6 +66,27 @@ func StartOperation(id string) error {
 	return nil
 }
 
+/*
+ * Replace the metadata of an operation, e.g. to report its progress.
+ */
+func UpdateOperationMetadata(id string, metadata lxd.Jmap) error {
+	md, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	op, ok := operations[id]
+	if !ok {
+		return fmt.Errorf("operation %s doesn't exist", id)
+	}
+
+	op.Metadata = md
+	op.UpdatedAt = time.Now()
+	return nil
+}
+
 func operationsGet(d *Daemon, r *http.Request) Response {
 	ops := lxd.Jmap{"pending": make([]string, 0, 0), "running": make([]string, 0, 0)}
 
@@ -83,7 +104,7 @@ func operationsGet(d *Daemon, r *http.Request) Response {
 	return SyncResponse(true, ops)
 }
 
-var operationsCmd = Command{"operations", false, false, operationsGet, nil, nil, nil}
+var operationsCmd = Command{"operations", false, false, operationsGet, nil, nil, nil, nil}
 
 func operationGet(d *Daemon, r *http.Request) Response {
 	id := lxd.OperationsURL(mux.Vars(r)["id"])
@@ -134,7 +155,7 @@ func operationDelete(d *Daemon, r *http.Request) Response {
 	}
 }
 
-var operationCmd = Command{"operations/{id}", false, false, operationGet, nil, nil, operationDelete}
+var operationCmd = Command{"operations/{id}", false, false, operationGet, nil, nil, operationDelete, nil}
 
 func operationWaitPost(d *Daemon, r *http.Request) Response {
 	lock.Lock()
@@ -158,4 +179,4 @@ func operationWaitPost(d *Daemon, r *http.Request) Response {
 	return SyncResponse(true, op)
 }
 
-var operationWait = Command{"operations/{id}/wait", false, false, nil, nil, operationWaitPost, nil}
+var operationWait = Command{"operations/{id}/wait", false, false, nil, nil, operationWaitPost, nil, nil}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lxc/lxd"
+	"gopkg.in/lxc/go-lxc.v2"
+)
+
+/*
+ * A profile is a named set of config keys which can be applied to any number
+ * of containers. Profiles are stored as one json file per profile under
+ * VarPath("profiles").
+ */
+type profile struct {
+	Name   string     `json:"name"`
+	Config []lxd.Jmap `json:"config"`
+}
+
+func profilesDir() string {
+	return lxd.VarPath("profiles")
+}
+
+func profilePath(name string) string {
+	return lxd.VarPath("profiles", name)
+}
+
+func validProfileName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("invalid profile name '%s'", name)
+	}
+
+	if strings.Contains(name, "/") {
+		return fmt.Errorf("profile names may not contain slashes")
+	}
+
+	return nil
+}
+
+func readProfile(name string) (*profile, error) {
+	if err := validProfileName(name); err != nil {
+		return nil, err
+	}
+
+	buf, err := ioutil.ReadFile(profilePath(name))
+	if err != nil {
+		return nil, err
+	}
+
+	p := profile{}
+	if err := json.Unmarshal(buf, &p); err != nil {
+		return nil, err
+	}
+	p.Name = name
+
+	return &p, nil
+}
+
+func writeProfile(p *profile) error {
+	if err := validProfileName(p.Name); err != nil {
+		return err
+	}
+
+	if err := validConfig(p.Config); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(profilesDir(), 0700); err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(profilePath(p.Name), buf, 0600)
+}
+
+/*
+ * Create the (empty) default profile if it doesn't exist yet, so that new
+ * containers always have something to start from.
+ */
+func initDefaultProfile() error {
+	_, err := os.Stat(profilePath("default"))
+	if err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	return writeProfile(&profile{Name: "default", Config: []lxd.Jmap{}})
+}
+
+/*
+ * Returns the names of all the containers which reference the profile.
+ */
+func profileUsers(d *Daemon, name string) ([]string, error) {
+	users := []string{}
+
+	for _, ct := range lxc.DefinedContainerNames(d.lxcpath) {
+		cc, err := readContainerConfig(ct)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, p := range cc.Profiles {
+			if p == name {
+				users = append(users, ct)
+				break
+			}
+		}
+	}
+
+	return users, nil
+}
+
+func profilesGet(d *Daemon, r *http.Request) Response {
+	files, err := ioutil.ReadDir(profilesDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return SyncResponse(true, []string{})
+		} else {
+			return InternalError(err)
+		}
+	}
+
+	body := make([]string, 0)
+
+	for _, file := range files {
+		if !file.IsDir() {
+			url := fmt.Sprintf("/%s/profiles/%s", lxd.APIVersion, file.Name())
+			body = append(body, url)
+		}
+	}
+
+	return SyncResponse(true, body)
+}
+
+func profilesPut(d *Daemon, r *http.Request) Response {
+	req := profile{}
+	if err := lxd.ReadToJson(r.Body, &req); err != nil {
+		return BadRequest(err)
+	}
+
+	if err := validProfileName(req.Name); err != nil {
+		return BadRequest(err)
+	}
+
+	if _, err := os.Stat(profilePath(req.Name)); err == nil {
+		return BadRequest(fmt.Errorf("profile %s already exists", req.Name))
+	}
+
+	if req.Config == nil {
+		req.Config = []lxd.Jmap{}
+	}
+
+	if err := validConfig(req.Config); err != nil {
+		return BadRequest(err)
+	}
+
+	if err := writeProfile(&req); err != nil {
+		return InternalError(err)
+	}
+
+	return EmptySyncResponse
+}
+
+var profilesCmd = Command{"profiles", false, false, profilesGet, profilesPut, nil, nil, nil}
+
+func profileGet(d *Daemon, r *http.Request) Response {
+	name := mux.Vars(r)["name"]
+
+	p, err := readProfile(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return NotFound
+		}
+		return SmartError(err)
+	}
+
+	return SyncResponse(true, p)
+}
+
+func profilePut(d *Daemon, r *http.Request) Response {
+	name := mux.Vars(r)["name"]
+
+	if _, err := readProfile(name); err != nil {
+		if os.IsNotExist(err) {
+			return NotFound
+		}
+		return SmartError(err)
+	}
+
+	req := profile{}
+	if err := lxd.ReadToJson(r.Body, &req); err != nil {
+		return BadRequest(err)
+	}
+
+	if req.Name != "" && req.Name != name {
+		return BadRequest(fmt.Errorf("profiles can only be renamed with POST"))
+	}
+	req.Name = name
+
+	if req.Config == nil {
+		req.Config = []lxd.Jmap{}
+	}
+
+	if err := validConfig(req.Config); err != nil {
+		return BadRequest(err)
+	}
+
+	if err := writeProfile(&req); err != nil {
+		return InternalError(err)
+	}
+
+	return EmptySyncResponse
+}
+
+func profilePost(d *Daemon, r *http.Request) Response {
+	name := mux.Vars(r)["name"]
+
+	if _, err := readProfile(name); err != nil {
+		if os.IsNotExist(err) {
+			return NotFound
+		}
+		return SmartError(err)
+	}
+
+	raw := lxd.Jmap{}
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		return BadRequest(err)
+	}
+
+	newName, err := raw.GetString("name")
+	if err != nil {
+		return BadRequest(err)
+	}
+
+	if err := validProfileName(newName); err != nil {
+		return BadRequest(err)
+	}
+
+	if _, err := os.Stat(profilePath(newName)); err == nil {
+		return BadRequest(fmt.Errorf("profile %s already exists", newName))
+	}
+
+	users, err := profileUsers(d, name)
+	if err != nil {
+		return InternalError(err)
+	}
+
+	if len(users) > 0 {
+		return BadRequest(fmt.Errorf("profile %s is in use by: %s", name, strings.Join(users, ", ")))
+	}
+
+	if err := os.Rename(profilePath(name), profilePath(newName)); err != nil {
+		return InternalError(err)
+	}
+
+	return EmptySyncResponse
+}
+
+func profileDelete(d *Daemon, r *http.Request) Response {
+	name := mux.Vars(r)["name"]
+
+	if _, err := readProfile(name); err != nil {
+		if os.IsNotExist(err) {
+			return NotFound
+		}
+		return SmartError(err)
+	}
+
+	users, err := profileUsers(d, name)
+	if err != nil {
+		return InternalError(err)
+	}
+
+	if len(users) > 0 {
+		return BadRequest(fmt.Errorf("profile %s is in use by: %s", name, strings.Join(users, ", ")))
+	}
+
+	if err := os.Remove(profilePath(name)); err != nil {
+		return InternalError(err)
+	}
+
+	return EmptySyncResponse
+}
+
+var profileCmd = Command{"profiles/{name}", false, false, profileGet, profilePut, profilePost, profileDelete, nil}
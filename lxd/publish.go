@@ -0,0 +1,339 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lxc/lxd"
+	"gopkg.in/lxc/go-lxc.v2"
+	"gopkg.in/yaml.v2"
+)
+
+type imagesPublishReq struct {
+	Source     lxd.Jmap          `json:"source"`
+	Public     bool              `json:"public"`
+	Properties map[string]string `json:"properties"`
+}
+
+/*
+ * Turn a container, or one of its snapshots, into an image. The source name
+ * is either "<container>" or "<container>/<snapshot>". Recipe sources build
+ * a new image instead, see imagesBuild.
+ */
+func imagesPublish(d *Daemon, r *http.Request) Response {
+	if d.id_map == nil {
+		return BadRequest(fmt.Errorf("lxd's user has no subuids"))
+	}
+
+	req := imagesPublishReq{}
+	if err := lxd.ReadToJson(r.Body, &req); err != nil {
+		return BadRequest(err)
+	}
+
+	type_, err := req.Source.GetString("type")
+	if err != nil {
+		return BadRequest(err)
+	}
+
+	switch type_ {
+	case "container":
+	case "recipe":
+		return imagesBuild(d, &req)
+	default:
+		return NotImplemented
+	}
+
+	source, err := req.Source.GetString("name")
+	if err != nil {
+		return BadRequest(err)
+	}
+
+	fields := strings.SplitN(source, "/", 2)
+	c, err := lxc.NewContainer(fields[0], d.lxcpath)
+	if err != nil {
+		return InternalError(err)
+	}
+
+	if !c.Defined() {
+		return NotFound
+	}
+
+	var rootfs string
+	if len(fields) == 2 {
+		rootfs = snapshotRootfsDir(c, fields[1])
+		if _, err := os.Stat(rootfs); err != nil {
+			if os.IsNotExist(err) {
+				return NotFound
+			}
+			return InternalError(err)
+		}
+	} else {
+		if c.State() != lxc.STOPPED {
+			return BadRequest(fmt.Errorf("container %s must be stopped to be published", c.Name()))
+		}
+		rootfs = c.ConfigItem("lxc.rootfs")[0]
+	}
+
+	meta, err := containerImageMetadata(c, req.Properties)
+	if err != nil {
+		return InternalError(err)
+	}
+
+	publish := func(id string) error {
+		fingerprint, err := writeImage(d, rootfs, meta, req.Public)
+		if err != nil {
+			return err
+		}
+
+		return UpdateOperationMetadata(id, lxd.Jmap{"fingerprint": fingerprint})
+	}
+
+	return AsyncResponseWithProgress(publish, nil, nil)
+}
+
+/*
+ * The metadata of an image made from a container, which carries the
+ * container's config along.
+ */
+func containerImageMetadata(c *lxc.Container, properties map[string]string) (*imageMetadata, error) {
+	cc, err := readContainerConfig(c.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	arch, err := hostArch()
+	if err != nil {
+		return nil, err
+	}
+
+	includes, err := lxcIncludes(c)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := imageMetadata{
+		Architecture: arch,
+		CreationDate: time.Now().Unix(),
+		Properties:   properties,
+		Config:       cc.Config,
+		Includes:     includes,
+	}
+	if meta.Properties == nil {
+		meta.Properties = map[string]string{}
+	}
+
+	return &meta, nil
+}
+
+/*
+ * Write a compressed image tarball of the rootfs into the image store and
+ * return its fingerprint.
+ */
+func writeImage(d *Daemon, rootfs string, meta *imageMetadata, public bool) (string, error) {
+	return writeImageFrom(rootfs, d.id_map, meta, public)
+}
+
+/*
+ * writeImage for a rootfs owned through idmap rather than ours, e.g. one
+ * unpacked as it came from an image server.
+ */
+func writeImageFrom(rootfs string, idmap *Idmap, meta *imageMetadata, public bool) (string, error) {
+	if err := os.MkdirAll(imagesDir(), 0700); err != nil {
+		return "", err
+	}
+
+	f, err := ioutil.TempFile(imagesDir(), "publish_")
+	if err != nil {
+		return "", err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	hash := sha256.New()
+	counter := &countingWriter{}
+	gz := gzip.NewWriter(io.MultiWriter(f, hash, counter))
+	tw := tar.NewWriter(gz)
+
+	err = func() error {
+		defer f.Close()
+
+		data, err := yaml.Marshal(meta)
+		if err != nil {
+			return err
+		}
+
+		hdr := &tar.Header{
+			Name:     "metadata.yaml",
+			Mode:     0644,
+			Size:     int64(len(data)),
+			ModTime:  time.Now(),
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+
+		if err := tarRootfs(tw, rootfs, "rootfs", idmap); err != nil {
+			return err
+		}
+
+		if err := tw.Close(); err != nil {
+			return err
+		}
+
+		return gz.Close()
+	}()
+	if err != nil {
+		return "", err
+	}
+
+	fingerprint := fmt.Sprintf("%x", hash.Sum(nil))
+	if _, err := os.Stat(imagePath(fingerprint)); err == nil {
+		lxd.Debugf("image %s already exists", fingerprint)
+		return fingerprint, nil
+	}
+
+	info := lxd.ImageInfo{
+		Fingerprint:  fingerprint,
+		Size:         counter.n,
+		Architecture: meta.Architecture,
+		CreationDate: meta.CreationDate,
+		UploadDate:   time.Now().Unix(),
+		Public:       public,
+		Properties:   meta.Properties,
+	}
+
+	if err := writeImageInfo(&info); err != nil {
+		return "", err
+	}
+
+	return fingerprint, os.Rename(tmp, imagePath(fingerprint))
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+/*
+ * Add everything under rootfs to the tarball as prefix/..., with ownership
+ * as seen from inside the container.
+ */
+func tarRootfs(tw *tar.Writer, rootfs string, prefix string, idmap *Idmap) error {
+	return tarRootfsFiltered(tw, rootfs, prefix, idmap, nil)
+}
+
+/*
+ * Like tarRootfs, but only add the entries include (if not nil) returns
+ * true for. include sees every entry, by its path relative to rootfs.
+ */
+func tarRootfsFiltered(tw *tar.Writer, rootfs string, prefix string, idmap *Idmap, include func(rel string, fi os.FileInfo) bool) error {
+	/* inode -> first path, to store hard links as such */
+	links := map[uint64]string{}
+
+	return filepath.Walk(rootfs, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fi.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+
+		rel, err := filepath.Rel(rootfs, p)
+		if err != nil {
+			return err
+		}
+
+		if include != nil && !include(rel, fi) {
+			return nil
+		}
+
+		rel = path.Join(prefix, rel)
+		if rel == "." {
+			return nil
+		}
+
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(p)
+			if err != nil {
+				return err
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+
+		hdr.Name = rel
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+
+		sb := fi.Sys().(*syscall.Stat_t)
+		uid, gid, err := idmap.Unshift(uint(sb.Uid), uint(sb.Gid))
+		if err != nil {
+			return fmt.Errorf("%s: %s", p, err)
+		}
+		hdr.Uid = int(uid)
+		hdr.Gid = int(gid)
+		hdr.Uname = ""
+		hdr.Gname = ""
+
+		xattrs, err := shiftedXattrs(p, fi, idmap, idmap.containerView(), hostShiftOps)
+		if err != nil {
+			return err
+		}
+		if len(xattrs) > 0 {
+			hdr.Xattrs = xattrs
+		}
+
+		if fi.Mode().IsRegular() && sb.Nlink > 1 {
+			if first, ok := links[sb.Ino]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				links[sb.Ino] = rel
+			}
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
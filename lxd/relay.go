@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/lxc/lxd"
+)
+
+/*
+ * Daemons which can't reach an image server have their clients download
+ * images for them. The client asks which image we'd download, fetches it
+ * and uploads it to the image store (see imagesPut) as a tarball of its
+ * files and their signatures, saying which image server and image it is.
+ * It is then turned into a cached image, which is what containers created
+ * with the "relay" flag are created from instead of downloading the image.
+ */
+func relayGet(d *Daemon, r *http.Request) Response {
+	q := r.URL.Query()
+
+	opts, err := downloadOptions(q.Get("url"), q.Get("name"), q.Get("variant"), q.Get("insecure") == "1")
+	if err != nil {
+		return BadRequest(err)
+	}
+
+	body := lxd.Jmap{
+		"distro":  opts.Distro,
+		"release": opts.Release,
+		"arch":    opts.Arch,
+		"variant": opts.Variant,
+	}
+
+	return SyncResponse(true, body)
+}
+
+var relayCmd = Command{"images/relay", false, false, relayGet, nil, nil, nil, nil}
+
+/*
+ * Turn a relayed image uploaded to the image store, a tarball of the
+ * image's meta.tar.xz and rootfs.tar.xz as found on the image server along
+ * with their .asc signatures if it has them, into a cached image of the
+ * image name from the image server at url.
+ */
+func importRelayedImage(d *Daemon, tarball string, url string, name string, insecure bool) (string, error) {
+	opts, err := downloadOptions(url, name, "", insecure)
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := imageTempDir("relay_")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	f, tr, err := openTarball(tarball)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	received := map[string]bool{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+
+		name := strings.TrimSuffix(hdr.Name, ".asc")
+		if name != "meta.tar.xz" && name != "rootfs.tar.xz" {
+			return "", fmt.Errorf("unexpected file %s in relayed image", hdr.Name)
+		}
+
+		out, err := os.Create(path.Join(dir, hdr.Name))
+		if err != nil {
+			return "", err
+		}
+
+		_, err = io.Copy(out, tr)
+		out.Close()
+		if err != nil {
+			return "", err
+		}
+
+		received[hdr.Name] = true
+	}
+
+	if !received["meta.tar.xz"] || !received["rootfs.tar.xz"] {
+		return "", fmt.Errorf("relayed image is incomplete")
+	}
+
+	return cacheServerImage(d, dir, imageCacheSource(url, opts), opts, insecure)
+}
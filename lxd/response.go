@@ -53,12 +53,21 @@ func SyncResponse(success bool, metadata interface{}) Response {
 var EmptySyncResponse = &syncResponse{true, make(map[string]interface{})}
 
 type asyncResponse struct {
-	run    func() error
-	cancel func() error
+	run         func() error
+	runProgress func(id string) error
+	cancel      func() error
+	metadata    lxd.Jmap
 }
 
 func (r *asyncResponse) Render(w http.ResponseWriter) error {
-	op, err := CreateOperation(nil, r.run, r.cancel)
+	var op string
+
+	run := r.run
+	if r.runProgress != nil {
+		run = func() error { return r.runProgress(op) }
+	}
+
+	op, err := CreateOperation(r.metadata, run, r.cancel)
 	if err != nil {
 		return err
 	}
@@ -71,7 +80,25 @@ func (r *asyncResponse) Render(w http.ResponseWriter) error {
 }
 
 func AsyncResponse(run func() error, cancel func() error) Response {
-	return &asyncResponse{run, cancel}
+	return &asyncResponse{run, nil, cancel, nil}
+}
+
+/*
+ * Like AsyncResponse, but the operation starts out with some metadata (e.g.
+ * the fingerprint of the image being imported) that clients can read once
+ * it is done.
+ */
+func AsyncResponseWithMetadata(run func() error, cancel func() error, metadata lxd.Jmap) Response {
+	return &asyncResponse{run, nil, cancel, metadata}
+}
+
+/*
+ * Like AsyncResponseWithMetadata, but run is handed the id of its operation
+ * so that it can report progress or results through
+ * UpdateOperationMetadata.
+ */
+func AsyncResponseWithProgress(run func(id string) error, cancel func() error, metadata lxd.Jmap) Response {
+	return &asyncResponse{nil, run, cancel, metadata}
 }
 
 type ErrorResponse struct {
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/lxc/lxd"
+	"gopkg.in/lxc/go-lxc.v2"
+)
+
+/*
+ * Containers, or their profiles, can have snapshots taken on a schedule:
+ *
+ *   snapshots.schedule   how often, e.g. "24h"
+ *   snapshots.retention  how many scheduled snapshots to keep
+ *   snapshots.max_age    how long to keep scheduled snapshots, e.g. "720h"
+ *
+ * Scheduled snapshots are named auto-<date>, are taken as operations like
+ * any other, and are the only snapshots the scheduler ever prunes. The
+ * scheduler also deletes snapshots whose expiry date is past. Protected
+ * snapshots are left alone either way. How often the scheduler looks for
+ * snapshots to take or delete is set with lxd's -snapshot-interval.
+ */
+
+const scheduledSnapshotPrefix = "auto-"
+
+type scheduledSnapshot struct {
+	name      string
+	created   int64
+	protected bool
+}
+
+type byCreation []scheduledSnapshot
+
+func (s byCreation) Len() int           { return len(s) }
+func (s byCreation) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byCreation) Less(i, j int) bool { return s[i].created < s[j].created }
+
+/*
+ * The scheduled snapshots of a container, oldest first.
+ */
+func scheduledSnapshots(c *lxc.Container) ([]scheduledSnapshot, error) {
+	files, err := ioutil.ReadDir(snapshotsDir(c))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	snapshots := []scheduledSnapshot{}
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+
+		meta, err := readSnapshotMetadata(c, file.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		if meta.Scheduled {
+			snapshots = append(snapshots, scheduledSnapshot{file.Name(), meta.CreationDate, meta.Protected})
+		}
+	}
+
+	sort.Sort(byCreation(snapshots))
+	return snapshots, nil
+}
+
+/*
+ * Remove the scheduled snapshots beyond the retention count (if not zero)
+ * or older than maxAge (if not zero).
+ */
+func pruneScheduledSnapshots(c *lxc.Container, retention int, maxAge time.Duration) error {
+	snapshots, err := scheduledSnapshots(c)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for i, snapshot := range snapshots {
+		tooMany := retention > 0 && len(snapshots)-i > retention
+		tooOld := maxAge > 0 && now.Sub(time.Unix(snapshot.created, 0)) > maxAge
+		if snapshot.protected || (!tooMany && !tooOld) {
+			continue
+		}
+
+		lxd.Debugf("pruning scheduled snapshot %s of %s", snapshot.name, c.Name())
+		if err := os.RemoveAll(snapshotDir(c, snapshot.name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+ * Take a scheduled snapshot of the container if one is due, and wait for
+ * it, so that a slow snapshot isn't taken twice. tried records when we last
+ * tried, so that failing snapshots are retried on schedule rather than on
+ * every tick.
+ */
+func (d *Daemon) scheduleSnapshot(c *lxc.Container, tried map[string]time.Time) error {
+	cc, err := readContainerConfig(c.Name())
+	if err != nil {
+		return err
+	}
+
+	config, err := lxdConfig(cc)
+	if err != nil {
+		return err
+	}
+
+	if config["snapshots.schedule"] == "" {
+		return nil
+	}
+
+	/* These were checked when they were set. */
+	schedule, _ := time.ParseDuration(config["snapshots.schedule"])
+	retention, _ := strconv.Atoi(config["snapshots.retention"])
+	var maxAge time.Duration
+	if config["snapshots.max_age"] != "" {
+		maxAge, _ = time.ParseDuration(config["snapshots.max_age"])
+	}
+
+	snapshots, err := scheduledSnapshots(c)
+	if err != nil {
+		return err
+	}
+
+	last := tried[c.Name()]
+	if len(snapshots) > 0 {
+		if created := time.Unix(snapshots[len(snapshots)-1].created, 0); created.After(last) {
+			last = created
+		}
+	}
+
+	now := time.Now()
+	if now.Sub(last) < schedule {
+		return nil
+	}
+	tried[c.Name()] = now
+
+	name := scheduledSnapshotPrefix + now.UTC().Format("20060102-150405")
+	meta := snapshotMetadata{CreationDate: now.Unix(), Description: "scheduled snapshot", Scheduled: true}
+
+	done := make(chan bool)
+	snapshot := func() error {
+		defer close(done)
+
+		if err := snapshotContainer(c, name, false, &meta); err != nil {
+			return err
+		}
+
+		return pruneScheduledSnapshots(c, retention, maxAge)
+	}
+
+	md := lxd.Jmap{"container": c.Name(), "snapshot": name}
+	op, err := CreateOperation(md, snapshot, nil)
+	if err != nil {
+		return err
+	}
+
+	lxd.Debugf("taking scheduled snapshot %s of %s", name, c.Name())
+	if err := StartOperation(op); err != nil {
+		return err
+	}
+
+	select {
+	case <-done:
+	case <-d.tomb.Dying():
+	}
+
+	return nil
+}
+
+/*
+ * Delete the container's snapshots which have expired.
+ */
+func expireSnapshots(c *lxc.Container) error {
+	files, err := ioutil.ReadDir(snapshotsDir(c))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	now := time.Now().Unix()
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+
+		meta, err := readSnapshotMetadata(c, file.Name())
+		if err != nil {
+			return err
+		}
+
+		if meta.Protected || meta.ExpiryDate == 0 || meta.ExpiryDate > now {
+			continue
+		}
+
+		lxd.Debugf("deleting expired snapshot %s of %s", file.Name(), c.Name())
+		if err := os.RemoveAll(snapshotDir(c, file.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *Daemon) snapshotScheduler() error {
+	ticker := time.NewTicker(d.snapshotInterval)
+	defer ticker.Stop()
+
+	tried := map[string]time.Time{}
+	for {
+		containers := lxc.DefinedContainers(d.lxcpath)
+		for i := range containers {
+			if err := expireSnapshots(&containers[i]); err != nil {
+				lxd.Logf("failed expiring snapshots of %s: %s", containers[i].Name(), err)
+			}
+
+			if err := d.scheduleSnapshot(&containers[i], tried); err != nil {
+				lxd.Logf("failed scheduling a snapshot of %s: %s", containers[i].Name(), err)
+			}
+		}
+
+		select {
+		case <-d.tomb.Dying():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
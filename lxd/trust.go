@@ -117,7 +117,7 @@ func trustPost(d *Daemon, r *http.Request) Response {
 	return EmptySyncResponse
 }
 
-var trustCmd = Command{"trust", false, true, trustGet, nil, trustPost, nil}
+var trustCmd = Command{"trust", false, true, trustGet, nil, trustPost, nil, nil}
 
 func trustFingerprintGet(d *Daemon, r *http.Request) Response {
 	fingerprint := mux.Vars(r)["fingerprint"]
@@ -133,4 +133,4 @@ func trustFingerprintGet(d *Daemon, r *http.Request) Response {
 	return NotFound
 }
 
-var trustFingerprintCmd = Command{"trust/{fingerprint}", false, false, trustFingerprintGet, nil, nil, nil}
+var trustFingerprintCmd = Command{"trust/{fingerprint}", false, false, trustFingerprintGet, nil, nil, nil, nil}
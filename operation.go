@@ -68,6 +68,14 @@ func (o *Operation) GetError() error {
 	}
 }
 
+func (o *Operation) MetadataAsMap() (*Jmap, error) {
+	ret := Jmap{}
+	if err := json.Unmarshal(o.Metadata, &ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
 func (o *Operation) SetStatus(status OperationStatus) {
 	o.Status = status
 	o.StatusCode = StatusCodes[status]
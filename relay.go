@@ -0,0 +1,446 @@
+package lxd
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// The index of the images an lxc-images server has for unprivileged
+// containers, one "distro;release;arch;variant;build;path" line per image.
+const imageIndexPath = "meta/1.0/index-user"
+
+// ImageFiles are the files making up an image on an lxc-images server. Each
+// of them may come with a detached signature, named after it plus ".asc".
+var ImageFiles = []string{"meta.tar.xz", "rootfs.tar.xz"}
+
+// remoteImage identifies an image on an lxc-images server.
+type remoteImage struct {
+	Distro  string `json:"distro"`
+	Release string `json:"release"`
+	Arch    string `json:"arch"`
+	Variant string `json:"variant"`
+}
+
+// ImageServerBase turns an image server url, e.g.
+// https+lxc-images://images.linuxcontainers.org, into the plain http(s) url
+// the images are served from.
+func ImageServerBase(addr string) (string, error) {
+	for _, scheme := range []string{"https", "http"} {
+		prefix := scheme + "+lxc-images://"
+		if strings.HasPrefix(addr, prefix) {
+			server := strings.TrimSuffix(strings.TrimPrefix(addr, prefix), "/")
+			return scheme + "://" + server, nil
+		}
+	}
+
+	return "", fmt.Errorf("unsupported image server %s", addr)
+}
+
+func relayQuery(imageURL string, imageName string, insecure bool) string {
+	q := url.Values{"url": []string{imageURL}, "name": []string{imageName}}
+	if insecure {
+		q.Set("insecure", "1")
+	}
+
+	return q.Encode()
+}
+
+// relayedImage asks the daemon which image it would download for imageName,
+// since the default release and architecture are the daemon's.
+func (c *Client) relayedImage(imageURL string, imageName string, insecure bool) (*remoteImage, error) {
+	uri := c.url(APIVersion, "images", "relay") + "?" + relayQuery(imageURL, imageName, insecure)
+
+	raw, err := c.http.Get(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := ParseResponse(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ParseError(resp); err != nil {
+		return nil, err
+	}
+
+	image := remoteImage{}
+	if err := json.Unmarshal(resp.Metadata, &image); err != nil {
+		return nil, err
+	}
+
+	return &image, nil
+}
+
+// FindServerImage looks an image up in the image server's index and returns
+// the path its files are under.
+func FindServerImage(base string, distro string, release string, arch string, variant string) (string, error) {
+	raw, err := http.Get(base + "/" + imageIndexPath)
+	if err != nil {
+		return "", err
+	}
+	defer raw.Body.Close()
+
+	if raw.StatusCode != 200 {
+		return "", fmt.Errorf("failed getting the image index from %s: %s", base, raw.Status)
+	}
+
+	scanner := bufio.NewScanner(raw.Body)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ";")
+		if len(fields) != 6 {
+			continue
+		}
+
+		if fields[0] == distro && fields[1] == release && fields[2] == arch && fields[3] == variant {
+			return fields[5], nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return "", fmt.Errorf("no image for %s/%s/%s (%s) on %s", distro, release, arch, variant, base)
+}
+
+// ErrNoSignature is returned by DownloadImage when the image server has no
+// signature for an image.
+var ErrNoSignature = fmt.Errorf("image is not signed")
+
+func downloadFile(uri string, target string) error {
+	raw, err := http.Get(uri)
+	if err != nil {
+		return err
+	}
+	defer raw.Body.Close()
+
+	if raw.StatusCode == 404 && strings.HasSuffix(uri, ".asc") {
+		return ErrNoSignature
+	}
+
+	if raw.StatusCode != 200 {
+		return fmt.Errorf("failed downloading %s: %s", uri, raw.Status)
+	}
+
+	f, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, raw.Body)
+	return err
+}
+
+// DownloadImage downloads the files of the image found at imagePath on an
+// image server into dir, along with their signatures. If the image server
+// has no signatures, the files are downloaded all the same and
+// ErrNoSignature is returned.
+func DownloadImage(base string, imagePath string, dir string) error {
+	signed := true
+
+	for _, file := range ImageFiles {
+		uri := base + path.Join("/", imagePath, file)
+		Debugf("downloading %s", uri)
+		if err := downloadFile(uri, path.Join(dir, file)); err != nil {
+			return err
+		}
+
+		err := downloadFile(uri+".asc", path.Join(dir, file+".asc"))
+		if err == ErrNoSignature {
+			signed = false
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if !signed {
+		return ErrNoSignature
+	}
+
+	return nil
+}
+
+// writeRelayTarball writes the image files found in dir, and whichever
+// signatures came with them, to w as the tarball the daemon imports relayed
+// images from.
+func writeRelayTarball(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+
+	files := []string{}
+	for _, file := range ImageFiles {
+		files = append(files, file, file+".asc")
+	}
+
+	for _, file := range files {
+		f, err := os.Open(path.Join(dir, file))
+		if os.IsNotExist(err) && strings.HasSuffix(file, ".asc") {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+
+		hdr := &tar.Header{
+			Name:     file,
+			Mode:     0644,
+			Size:     fi.Size(),
+			ModTime:  fi.ModTime(),
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			f.Close()
+			return err
+		}
+
+		_, err = io.Copy(tw, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// RelayImage downloads an image from an image server and imports it into the
+// daemon's image store, for daemons which can't reach the image server
+// themselves. Containers are then created from it with CreateRelayed.
+// insecure is whether the user marked the image server as insecure.
+func (c *Client) RelayImage(imageURL string, imageName string, insecure bool) error {
+	base, err := ImageServerBase(imageURL)
+	if err != nil {
+		return err
+	}
+
+	image, err := c.relayedImage(imageURL, imageName, insecure)
+	if err != nil {
+		return err
+	}
+
+	imagePath, err := FindServerImage(base, image.Distro, image.Release, image.Arch, image.Variant)
+	if err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", "lxc-relay")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := DownloadImage(base, imagePath, dir); err != nil && err != ErrNoSignature {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeRelayTarball(pw, dir))
+	}()
+
+	req, err := http.NewRequest("PUT", c.url(APIVersion, "images"), pr)
+	if err != nil {
+		pr.Close()
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-tar")
+	req.Header.Set("X-LXD-source-url", imageURL)
+	req.Header.Set("X-LXD-source-name", imageName)
+	if insecure {
+		req.Header.Set("X-LXD-insecure", "1")
+	}
+
+	raw, err := c.http.Do(req)
+	if err != nil {
+		pr.Close()
+		return err
+	}
+
+	resp, err := ParseResponse(raw)
+	if err != nil {
+		return err
+	}
+
+	if err := ParseError(resp); err != nil {
+		return err
+	}
+
+	if resp.Type != Async {
+		return fmt.Errorf("Non-async response from image import!")
+	}
+
+	return c.WaitForSuccess(resp.Operation)
+}
+
+// CreateRelayed creates a container from an image previously handed to the
+// daemon with RelayImage.
+func (c *Client) CreateRelayed(name string, imageURL string, imageName string, insecure bool) (*Response, error) {
+	source := Jmap{"type": "remote", "url": imageURL, "name": imageName, "relay": true, "insecure": insecure}
+	return c.createContainer(name, source)
+}
+
+// TransferProgress is told, as a container is relayed, which phase of the
+// migration is being relayed and how many bytes of it so far.
+type TransferProgress func(phase string, bytes int64)
+
+// RelayMigrateTo is MigrateTo for daemons which can't reach each other: the
+// container goes through the client instead.
+func (c *Client) RelayMigrateTo(dest *Client, name string, newName string, progress TransferProgress) error {
+	return c.transfer(dest, name, fmt.Sprintf("containers/%s", name), Jmap{"migration": true}, newName, false, progress)
+}
+
+// RelayCopyTo is CopyTo for daemons which can't reach each other: the copy
+// goes through the client instead.
+func (c *Client) RelayCopyTo(dest *Client, source string, newName string, snapshots bool, progress TransferProgress) error {
+	name, resource, body := copySource(source, snapshots)
+	return c.transfer(dest, name, resource, body, newName, true, progress)
+}
+
+// How often a relayed transfer reports progress
+const relayProgressInterval = 200 * time.Millisecond
+
+type progressReader struct {
+	r        io.Reader
+	phase    string
+	n        int64
+	reported time.Time
+	progress TransferProgress
+}
+
+func (p *progressReader) Read(buf []byte) (int, error) {
+	n, err := p.r.Read(buf)
+	p.n += int64(n)
+
+	if err == io.EOF || time.Since(p.reported) >= relayProgressInterval {
+		p.progress(p.phase, p.n)
+		p.reported = time.Now()
+	}
+
+	return n, err
+}
+
+// relayMigration pulls each phase of a migration from c's daemon and pushes
+// it to dest's, which waits for them.
+func (c *Client) relayMigration(dest *Client, name string, newName string, secret string, live bool, progress TransferProgress) error {
+	phases := []string{"filesystem"}
+	if live {
+		phases = append(phases, "delta", "state")
+	}
+
+	for _, phase := range phases {
+		body, err := c.pullMigration(name, secret, phase)
+		if err != nil {
+			return err
+		}
+
+		err = dest.pushMigration(newName, phase, &progressReader{r: body, phase: phase, progress: progress})
+		body.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func migrationQuery(secret string, phase string) string {
+	query := url.Values{"phase": []string{phase}}
+	if secret != "" {
+		query.Set("secret", secret)
+	}
+
+	return query.Encode()
+}
+
+// pullMigration gets one phase of a migration from c's daemon, as its
+// target would.
+func (c *Client) pullMigration(name string, secret string, phase string) (io.ReadCloser, error) {
+	uri := c.url(APIVersion, "containers", name, "migration") + "?" + migrationQuery(secret, phase)
+
+	raw, err := c.http.Get(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	if raw.StatusCode != 200 {
+		resp, err := ParseResponse(raw)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := ParseError(resp); err != nil {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("unexpected response from the migration source")
+	}
+
+	return raw.Body, nil
+}
+
+// pushMigration hands one phase of a migration over to c's daemon, which
+// is the target of a relayed migration into the container name.
+func (c *Client) pushMigration(name string, phase string, body io.Reader) error {
+	uri := c.url(APIVersion, "containers", name, "migration") + "?" + migrationQuery("", phase)
+
+	req, err := http.NewRequest("PUT", uri, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-tar")
+
+	raw, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+
+	resp, err := ParseResponse(raw)
+	if err != nil {
+		return err
+	}
+
+	return ParseError(resp)
+}
+
+// abortRelay tells c's daemon that the migration relayed into the container
+// name won't get any further.
+func (c *Client) abortRelay(name string) error {
+	resp, err := c.delete_(fmt.Sprintf("containers/%s/migration", name), nil)
+	if err != nil {
+		return err
+	}
+
+	return ParseError(resp)
+}
+
+// reportMigration tells c's daemon how a migration it is the source of
+// went, as its target would.
+func (c *Client) reportMigration(name string, secret string, result error) error {
+	body := Jmap{"secret": secret}
+	if result != nil {
+		body["error"] = result.Error()
+	}
+
+	resp, err := c.post(fmt.Sprintf("containers/%s/migration", name), body)
+	if err != nil {
+		return err
+	}
+
+	return ParseError(resp)
+}
@@ -0,0 +1,35 @@
+test_container_config() {
+  if ! which curl >/dev/null || ! grep -q "^$(whoami):" /etc/subuid; then
+    echo "==> SKIP: container config needs curl and subuids"
+    return
+  fi
+
+  import_test_image testconfig "test config image"
+
+  lxc create testconfig testconfig1
+
+  # Bad keys and values are refused up front
+  ! lxd_api PUT /1.0/containers/testconfig1 -d '{"config": [{"key": "nosuchkey", "value": "1"}]}' | grep -q '"operation"'
+  ! lxd_api PUT /1.0/containers/testconfig1 -d '{"config": [{"key": "snapshots.retention", "value": "-1"}]}' | grep -q '"operation"'
+
+  lxd_api PUT /1.0/containers/testconfig1 -d '{"profiles": ["default"], "config": [{"key": "resources.cpu_shares", "value": "512"}]}' | lxd_wait
+  lxd_api GET /1.0/containers/testconfig1 | grep cpu_shares
+
+  # The config outlives the daemon, and is never written to the lxc config
+  echo "Restarting lxd"
+  kill -9 ${lxd_pid}
+  rm -f "${LXD_DIR}/unix.socket"
+  spawn_lxd
+
+  lxd_api GET /1.0/containers/testconfig1 | grep cpu_shares
+  ! grep cpu.shares "${LXD_DIR}/lxc/testconfig1/config"
+
+  # Removed keys stay removed
+  lxd_api PUT /1.0/containers/testconfig1 -d '{"profiles": ["default"], "config": []}' | lxd_wait
+  ! lxd_api GET /1.0/containers/testconfig1 | grep -q cpu_shares
+  ! grep cpu.shares "${LXD_DIR}/lxc/testconfig1/config"
+
+  lxc delete testconfig1
+  lxc image delete "${fingerprint}"
+  rm -rf testconfig testconfig.tar.gz
+}
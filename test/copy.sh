@@ -0,0 +1,41 @@
+test_copy() {
+  if ! grep -q "^$(whoami):" /etc/subuid; then
+    echo "==> SKIP: copying containers needs subuids"
+    return
+  fi
+
+  import_test_image testcopy "test copy image"
+
+  lxc create testcopy testcopy1
+  lxc snapshot testcopy1 snap0
+
+  lxc copy testcopy1 testcopy2
+  lxc copy testcopy1/snap0 testcopy3
+  lxc list | grep testcopy2
+  lxc list | grep testcopy3
+  lxc file pull testcopy3/etc/hostname testcopy/hostname
+  grep testcopy testcopy/hostname
+
+  # Copies get their own MAC addresses
+  if which curl >/dev/null; then
+    lxd_api PUT /1.0/containers/testcopy1 -d '{"profiles": ["default"], "config": [{"key": "network.0.hwaddr", "value": "00:16:3e:00:00:01"}]}' | lxd_wait
+    lxc copy testcopy1 testcopy4
+    lxc copy testcopy1/snap0 testcopy5
+    lxd_api GET /1.0/containers/testcopy1 | grep hwaddr
+    ! lxd_api GET /1.0/containers/testcopy4 | grep -q hwaddr
+    ! lxd_api GET /1.0/containers/testcopy5 | grep -q hwaddr
+    ! grep hwaddr "${LXD_DIR}/lxc/testcopy4/config"
+    lxc delete testcopy4
+    lxc delete testcopy5
+  fi
+
+  # Copies need a new name
+  ! lxc copy testcopy1 testcopy2
+  ! lxc copy testcopy1/nosuchsnap testcopy4
+
+  lxc delete testcopy1
+  lxc delete testcopy2
+  lxc delete testcopy3
+  lxc image delete "${fingerprint}"
+  rm -rf testcopy testcopy.tar.gz
+}
@@ -0,0 +1,71 @@
+test_image_download() {
+  if ! which python3 >/dev/null || ! grep -q "^$(whoami):" /etc/subuid; then
+    echo "==> SKIP: image downloads need python3 and subuids"
+    return
+  fi
+
+  rm -rf testdownload testconf || true
+  mkdir -p testdownload/meta testdownload/rootfs/etc
+  mkdir -p testdownload/srv/meta/1.0 testdownload/srv/images/testdownload/1
+
+  echo "lxc.arch = x86_64" > testdownload/meta/config
+  echo "/etc/hostname" > testdownload/meta/templates
+  echo "LXC_NAME" > testdownload/rootfs/etc/hostname
+  srv=testdownload/srv/images/testdownload/1
+  tar -C testdownload/meta -cJf ${srv}/meta.tar.xz .
+  tar -C testdownload/rootfs -cJf ${srv}/rootfs.tar.xz .
+  echo "testdownload;1;amd64;default;1;/images/testdownload/1/" > testdownload/srv/meta/1.0/index-user
+
+  (cd testdownload/srv && exec python3 -m http.server 8445) &
+  server_pid=$!
+  sleep 1
+
+  # Plain http image servers have to be marked insecure
+  lxc remote --config ./testconf add testdownload http+lxc-images://127.0.0.1:8445
+  ! lxc create --config ./testconf testdownload:testdownload/1/amd64 download1 2> testdownload/err
+  grep "only used when marked insecure" testdownload/err
+  ! lxc list | grep -q download1
+
+  lxc remote --config ./testconf add testinsecure http+lxc-images://127.0.0.1:8445 --insecure
+  lxc remote --config ./testconf list | grep 'testinsecure.*(insecure)'
+  lxc create --config ./testconf testinsecure:testdownload/1/amd64 download1
+  lxc list | grep download1
+  grep -q download1 "${LXD_DIR}/lxc/download1/rootfs/etc/hostname"
+
+  # The image is cached as it came from the image server, before the
+  # container's name was put in it
+  cached=$(lxc image list)
+  lxc image show "${cached}" | grep "cached: true"
+  lxc image show "${cached}" | grep "verified: false"
+  kill ${server_pid}
+  lxc create --config ./testconf testinsecure:testdownload/1/amd64 download2
+  [ "$(lxc image list)" = "${cached}" ]
+  grep -q download2 "${LXD_DIR}/lxc/download2/rootfs/etc/hostname"
+  ! grep -q download1 "${LXD_DIR}/lxc/download2/rootfs/etc/hostname"
+
+  lxc delete download1
+  lxc delete download2
+  lxc image delete "${cached}"
+
+  # Relayed images are imported into the image store by the client
+  (cd testdownload/srv && exec python3 -m http.server 8445) &
+  server_pid=$!
+  sleep 1
+
+  lxc remote --config ./testconf add testrelay http+lxc-images://127.0.0.1:8445 --insecure --always-relay
+  lxc create --config ./testconf testrelay:testdownload/1/amd64 download3
+  grep -q download3 "${LXD_DIR}/lxc/download3/rootfs/etc/hostname"
+  relayed=$(lxc image list)
+  lxc image show "${relayed}" | grep "cached: true"
+  lxc image show "${relayed}" | grep "source: http+lxc-images://127.0.0.1:8445/testdownload/1/amd64/default"
+
+  # and used like any cached image
+  kill ${server_pid}
+  lxc create --config ./testconf testinsecure:testdownload/1/amd64 download4
+  [ "$(lxc image list)" = "${relayed}" ]
+
+  lxc delete download3
+  lxc delete download4
+  lxc image delete "${relayed}"
+  rm -rf testdownload testconf
+}
@@ -0,0 +1,69 @@
+test_images() {
+  rm -rf testimage || true
+  mkdir -p testimage/rootfs/etc
+  echo "testimage" > testimage/rootfs/etc/hostname
+  cat > testimage/metadata.yaml <<EOM
+architecture: x86_64
+creation_date: 1424284563
+properties:
+  description: test image
+EOM
+  tar -C testimage -czf testimage.tar.gz metadata.yaml rootfs
+  fingerprint=$(sha256sum testimage.tar.gz | cut -d' ' -f1)
+
+  lxc image import testimage.tar.gz | grep "${fingerprint}"
+  lxc image list | grep "${fingerprint}"
+  lxc image show "${fingerprint}" | grep "test image"
+  lxc image show "${fingerprint}" | grep "public: false"
+
+  mkdir -p testexport
+  lxc image export "${fingerprint}" testexport
+  cmp testimage.tar.gz "testexport/${fingerprint}.tar.gz"
+  rm -rf testexport
+
+  lxc image alias create testimage/foo "${fingerprint}"
+  lxc image alias list | grep "testimage/foo -> ${fingerprint}"
+  ! lxc image alias create testimage/foo "${fingerprint}"
+  ! lxc image alias create testimage/bar 0000000000
+  lxc image alias rename testimage/foo testimage/bar
+  lxc image show testimage/bar | grep "test image"
+  lxc image alias delete testimage/bar
+  ! lxc image alias list | grep -q testimage
+
+  # Abbreviated fingerprints work too
+  lxc image delete "$(echo ${fingerprint} | cut -c1-12)"
+  ! lxc image list | grep -q "${fingerprint}"
+
+  lxc image import testimage.tar.gz --public
+  lxc image show "${fingerprint}" | grep "public: true"
+
+  # Untrusted clients only get to list and download public images
+  mkdir -p testimage/private/rootfs/etc
+  echo "private" > testimage/private/rootfs/etc/hostname
+  cp testimage/metadata.yaml testimage/private/metadata.yaml
+  tar -C testimage/private -czf testimage/private.tar.gz metadata.yaml rootfs
+  private=$(sha256sum testimage/private.tar.gz | cut -d' ' -f1)
+  lxc image import testimage/private.tar.gz
+
+  if which curl openssl >/dev/null; then
+    openssl req -x509 -newkey rsa:2048 -nodes -days 1 -subj /CN=untrusted \
+      -keyout testimage/untrusted.key -out testimage/untrusted.crt 2>/dev/null
+    untrusted="curl -s -k --cert testimage/untrusted.crt --key testimage/untrusted.key https://127.0.0.1:8443"
+
+    ${untrusted}/1.0/images | grep "${fingerprint}"
+    ! ${untrusted}/1.0/images | grep -q "${private}"
+    ${untrusted}/1.0/images/${fingerprint} | grep '"public":true'
+    ${untrusted}/1.0/images/${private} | grep "not authorized"
+    ${untrusted}/1.0/images/${fingerprint}/export > testimage/public.tar.gz
+    cmp testimage.tar.gz testimage/public.tar.gz
+    ${untrusted}/1.0/images/${private}/export | grep "not authorized"
+    ${untrusted}/1.0/containers | grep "not authorized"
+  else
+    echo "==> SKIP: untrusted image access needs curl and openssl"
+  fi
+
+  lxc image delete "${private}"
+  lxc image delete "${fingerprint}"
+
+  rm -rf testimage testimage.tar.gz
+}
@@ -3,31 +3,81 @@ export PATH=../lxc:../lxd:$PATH
 export LXD_DIR=$(mktemp -d)
 RESULT=failure
 lxd_pid=0
+lxd2_pid=0
+LXD2_DIR=$(mktemp -d)
 
 echo "Running the LXD testsuite"
 
 cleanup() {
     [ "${lxd_pid}" -gt "0" ] && kill -9 ${lxd_pid}
-    rm -Rf ${LXD_DIR}
+    [ "${lxd2_pid}" -gt "0" ] && kill -9 ${lxd2_pid}
+    rm -Rf ${LXD_DIR} ${LXD2_DIR}
     echo "Test result: $RESULT"
 }
 
+# lxc has no commands for some of the API, so talk to the local lxd directly
+lxd_api() {
+  method=$1
+  path=$2
+  shift 2
+  curl -s --unix-socket "${LXD_DIR}/unix.socket" -X "${method}" "$@" "http://unix.socket${path}"
+}
+
+# Wait for the operation of the async response on stdin, failing if it fails
+lxd_wait() {
+  op=$(sed -n 's/.*"operation":"\([^"]*\)".*/\1/p')
+  [ -n "${op}" ] || return 1
+  ! lxd_api POST "${op}/wait" | grep -q '"result":"failure"'
+}
+
+# Build a minimal image described as $2 in ./$1, import it from $1.tar.gz and
+# alias it as $1, leaving its fingerprint in ${fingerprint}
+import_test_image() {
+  rm -rf "$1" || true
+  mkdir -p "$1/rootfs/etc"
+  echo "$1" > "$1/rootfs/etc/hostname"
+  cat > "$1/metadata.yaml" <<EOM
+architecture: x86_64
+creation_date: 1424284563
+properties:
+  description: $2
+EOM
+  tar -C "$1" -czf "$1.tar.gz" metadata.yaml rootfs
+  fingerprint=$(sha256sum "$1.tar.gz" | cut -d' ' -f1)
+  lxc image import "$1.tar.gz"
+  lxc image alias create "$1" "${fingerprint}"
+}
+
+# Start the local lxd in the background and wait until it answers
+spawn_lxd() {
+  lxd --tcp 127.0.0.1:8443 --snapshot-interval=1s &
+  lxd_pid=$!
+  alive=0
+  while [ $alive -eq 0 ]; do
+    lxc finger && alive=1 || true
+  done
+}
+
 set -e
 
 trap cleanup EXIT HUP INT TERM
 
 . ./remote.sh
+. ./images.sh
+. ./download.sh
+. ./signing.sh
+. ./oci.sh
+. ./publish.sh
+. ./move.sh
+. ./copy.sh
+. ./snapshots.sh
+. ./profiles.sh
+. ./config.sh
+. ./migration.sh
 . ./signoff.sh
 
 echo "Spawning lxd"
-lxd --tcp 127.0.0.1:8443 &
-lxd_pid=$!
-
-echo "Confirming lxd is responsive"
-alive=0
-while [ $alive -eq 0 ]; do
-  lxc finger && alive=1 || true
-done
+spawn_lxd
 
 echo "Setting trust password"
 lxc config set password foo
@@ -35,6 +85,39 @@ lxc config set password foo
 echo "TEST: lxc remote"
 test_remote
 
+echo "TEST: images"
+test_images
+
+echo "TEST: image downloads"
+test_image_download
+
+echo "TEST: image signing"
+test_image_signing
+
+echo "TEST: application images"
+test_oci_import
+
+echo "TEST: lxc publish"
+test_publish
+
+echo "TEST: lxc move"
+test_move
+
+echo "TEST: lxc copy"
+test_copy
+
+echo "TEST: snapshots"
+test_snapshots
+
+echo "TEST: profiles"
+test_profiles
+
+echo "TEST: container config"
+test_container_config
+
+echo "TEST: migration"
+test_migration
+
 echo "TEST: commit sign-off"
 test_commits_signed_off
 
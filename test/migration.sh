@@ -0,0 +1,134 @@
+test_migration() {
+  if ! which curl >/dev/null || ! grep -q "^$(whoami):" /etc/subuid; then
+    echo "==> SKIP: migration needs curl and subuids"
+    return
+  fi
+
+  echo "Spawning a second lxd"
+  LXD_DIR=${LXD2_DIR} lxd --tcp 127.0.0.1:8446 &
+  lxd2_pid=$!
+
+  alive=0
+  while [ $alive -eq 0 ]; do
+    LXD_DIR=${LXD2_DIR} lxc finger && alive=1 || true
+  done
+  LXD_DIR=${LXD2_DIR} lxc config set password foo
+
+  rm -f testconf || true
+  (echo y;  sleep 3;  echo foo) | lxc remote --config ./testconf add lxd2 127.0.0.1:8446
+
+  import_test_image testmig "test migration image"
+
+  lxc create testmig testmig1
+  lxc snapshot testmig1 snap0
+
+  # To the second daemon and back again, under a new name
+  lxc move --config ./testconf testmig1 lxd2:
+  lxc list --config ./testconf lxd2: | grep testmig1
+  ! lxc list | grep -q testmig1
+  lxc snapshot list --config ./testconf lxd2:testmig1 | grep snap0
+  [ -f "${LXD2_DIR}/lxc/testmig1/snapshots/snap0/rootfs/etc/hostname" ]
+  lxc file pull --config ./testconf lxd2:testmig1/etc/hostname testmig/hostname
+  grep testmig testmig/hostname
+
+  lxc move --config ./testconf lxd2:testmig1 testmig2
+  lxc list | grep testmig2
+  ! lxc list --config ./testconf lxd2: | grep -q testmig1
+  lxc snapshot list testmig2 | grep snap0
+  [ -f "${LXD_DIR}/lxc/testmig2/snapshots/snap0/rootfs/etc/hostname" ]
+  lxc restore testmig2 snap0
+
+  # A failed migration leaves the container where it was
+  lxc copy testmig2 testmig3
+  lxc move --config ./testconf testmig2 lxd2:
+  ! lxc move --config ./testconf testmig3 lxd2:testmig2
+  lxc list | grep testmig3
+
+  # Copies leave the source alone, and only bring snapshots if asked to
+  lxc snapshot testmig3 snap1
+  lxc copy --config ./testconf testmig3 lxd2:testmig4
+  lxc list | grep testmig3
+  lxc list --config ./testconf lxd2: | grep testmig4
+  ! lxc snapshot list --config ./testconf lxd2:testmig4 | grep -q snap1
+  lxc copy --config ./testconf --snapshots testmig3 lxd2:testmig5
+  lxc snapshot list --config ./testconf lxd2:testmig5 | grep snap1
+  lxc copy --config ./testconf testmig3/snap1 lxd2:testmig6
+
+  # Copies get their own MAC addresses
+  lxd_api PUT /1.0/containers/testmig3 -d '{"profiles": ["default"], "config": [{"key": "network.0.hwaddr", "value": "00:16:3e:00:00:01"}]}' | lxd_wait
+  lxc copy --config ./testconf testmig3 lxd2:testmig8
+  (LXD_DIR=${LXD2_DIR}; lxd_api GET /1.0/containers/testmig8) | grep '"testmig8"'
+  ! (LXD_DIR=${LXD2_DIR}; lxd_api GET /1.0/containers/testmig8) | grep -q hwaddr
+  lxc delete --config ./testconf lxd2:testmig8
+  lxd_api PUT /1.0/containers/testmig3 -d '{"profiles": ["default"], "config": []}' | lxd_wait
+  lxc file pull --config ./testconf lxd2:testmig6/etc/hostname testmig/hostname
+  grep testmig testmig/hostname
+  lxc snapshot list testmig3 | grep snap1
+
+  # The client relays containers for remotes added with --always-relay
+  (echo y;  sleep 3;  echo foo) | lxc remote --config ./testconf add --always-relay lxd2relay 127.0.0.1:8446
+  lxc move --config ./testconf testmig3 lxd2relay:testmig7
+  lxc list --config ./testconf lxd2: | grep testmig7
+  ! lxc list | grep -q testmig3
+  lxc copy --config ./testconf --snapshots lxd2relay:testmig7 testmig3
+  lxc snapshot list testmig3 | grep snap1
+  lxc list --config ./testconf lxd2: | grep testmig7
+  lxc delete --config ./testconf lxd2:testmig7
+
+  # Running containers move live, and keep running where they were if the
+  # target fails
+  if which criu busybox >/dev/null && ldd "$(which busybox)" 2>&1 | grep -q "not a dynamic"; then
+    mkdir -p testmig/live/rootfs/bin testmig/live/rootfs/sbin testmig/live/rootfs/etc
+    mkdir -p testmig/live/rootfs/dev testmig/live/rootfs/proc testmig/live/rootfs/sys testmig/live/rootfs/tmp
+    cp "$(which busybox)" testmig/live/rootfs/bin/busybox
+    ln -s busybox testmig/live/rootfs/bin/sh
+    ln -s busybox testmig/live/rootfs/bin/sleep
+    printf '#!/bin/sh\nexec sleep 1000000\n' > testmig/live/rootfs/sbin/init
+    chmod +x testmig/live/rootfs/sbin/init
+    echo "testmiglive" > testmig/live/rootfs/etc/hostname
+    cp testmig/metadata.yaml testmig/live/metadata.yaml
+    tar -C testmig/live -czf testmiglive.tar.gz metadata.yaml rootfs
+    live_fingerprint=$(sha256sum testmiglive.tar.gz | cut -d' ' -f1)
+    lxc image import testmiglive.tar.gz
+    lxc image alias create testmiglive "${live_fingerprint}"
+
+    lxc create testmiglive testmig8
+    lxc start testmig8
+    for i in $(seq 10); do
+      lxd_api GET /1.0/containers/testmig8 | grep -q RUNNING && break
+      sleep 1
+    done
+    lxd_api GET /1.0/containers/testmig8 | grep RUNNING
+
+    lxc copy --config ./testconf testmig8 lxd2:testmig8
+    ! lxc move --config ./testconf testmig8 lxd2:
+    lxd_api GET /1.0/containers/testmig8 | grep RUNNING
+    lxc delete --config ./testconf lxd2:testmig8
+
+    lxc move --config ./testconf testmig8 lxd2:
+    ! lxc list | grep -q testmig8
+    (LXD_DIR=${LXD2_DIR}; lxd_api GET /1.0/containers/testmig8) | grep RUNNING
+
+    lxc stop --config ./testconf lxd2:testmig8
+    for i in $(seq 10); do
+      (LXD_DIR=${LXD2_DIR}; lxd_api GET /1.0/containers/testmig8) | grep -q STOPPED && break
+      sleep 1
+    done
+    lxc delete --config ./testconf lxd2:testmig8
+    lxc image delete "${live_fingerprint}"
+    rm -f testmiglive.tar.gz
+  else
+    echo "==> SKIP: live migration needs criu and a static busybox"
+  fi
+
+  lxc delete --config ./testconf lxd2:testmig2
+  lxc delete --config ./testconf lxd2:testmig4
+  lxc delete --config ./testconf lxd2:testmig5
+  lxc delete --config ./testconf lxd2:testmig6
+  lxc delete testmig3
+  lxc image delete "${fingerprint}"
+  rm -rf testmig testmig.tar.gz testconf
+
+  kill -9 ${lxd2_pid}
+  lxd2_pid=0
+}
@@ -0,0 +1,28 @@
+test_move() {
+  if ! grep -q "^$(whoami):" /etc/subuid; then
+    echo "==> SKIP: moving containers needs subuids"
+    return
+  fi
+
+  import_test_image testmove "test move image"
+
+  lxc create testmove testmove1
+  lxc snapshot testmove1 snap0
+  lxc create testmove testmove3
+
+  lxc move testmove1 testmove2
+  lxc list | grep testmove2
+  ! lxc list | grep -q testmove1
+  lxc file pull testmove2/etc/hostname testmove/hostname
+  grep testmove testmove/hostname
+  lxc snapshot list testmove2 | grep snap0
+  ! lxc snapshot list testmove1
+
+  # Renaming over an existing container fails
+  ! lxc move testmove2 testmove3
+
+  lxc delete testmove2
+  lxc delete testmove3
+  lxc image delete "${fingerprint}"
+  rm -rf testmove testmove.tar.gz
+}
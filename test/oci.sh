@@ -0,0 +1,68 @@
+test_oci_import() {
+  if ! grep -q "^$(whoami):" /etc/subuid; then
+    echo "==> SKIP: application images need subuids"
+    return
+  fi
+
+  rm -rf testoci || true
+  mkdir -p testoci/layer1/etc/opaque testoci/layer2/etc/opaque testoci/image
+
+  # A base layer, and one which deletes some of it
+  echo "testoci" > testoci/layer1/etc/hostname
+  echo "removed" > testoci/layer1/etc/removed
+  echo "old" > testoci/layer1/etc/opaque/old
+  touch testoci/layer2/etc/.wh.removed testoci/layer2/etc/opaque/.wh..wh..opq
+  echo "new" > testoci/layer2/etc/opaque/new
+  tar -C testoci/layer1 -cf testoci/image/layer1.tar etc
+  tar -C testoci/layer2 -cf testoci/image/layer2.tar etc
+  layer1=$(sha256sum testoci/image/layer1.tar | cut -d' ' -f1)
+  layer2=$(sha256sum testoci/image/layer2.tar | cut -d' ' -f1)
+
+  cat > testoci/image/config.json <<EOM
+{"architecture": "amd64", "os": "linux", "created": "2015-03-01T12:00:00Z",
+ "config": {"Env": ["TESTOCI=1"], "Entrypoint": ["/bin/sh"], "WorkingDir": "/etc"},
+ "rootfs": {"type": "layers", "diff_ids": ["sha256:${layer1}", "sha256:${layer2}"]}}
+EOM
+  cat > testoci/image/manifest.json <<EOM
+[{"Config": "config.json", "RepoTags": ["testoci:latest"], "Layers": ["layer1.tar", "layer2.tar"]}]
+EOM
+
+  # Layers which aren't what the image says they are are refused
+  mv testoci/image/layer2.tar testoci/layer2.tar
+  cp testoci/image/layer1.tar testoci/image/layer2.tar
+  tar -C testoci/image -cf testoci.tar .
+  ! lxc image import testoci.tar 2> testoci/err
+  grep "bad layer layer2.tar" testoci/err
+  mv testoci/layer2.tar testoci/image/layer2.tar
+
+  tar -C testoci/image -cf testoci.tar .
+
+  lxc image import testoci.tar > testoci/out
+  fingerprint=$(awk '{print $NF}' testoci/out)
+  lxc image show "${fingerprint}" | grep "testoci:latest"
+
+  lxc image alias create testoci "${fingerprint}"
+  lxc create testoci testoci
+  if which curl >/dev/null; then
+    lxd_api GET /1.0/containers/testoci | grep '"key":"lxc.init_cwd","value":"/etc"'
+  fi
+  lxc file pull testoci/etc/hostname testoci/hostname
+  grep testoci testoci/hostname
+  lxc file pull testoci/etc/opaque/new testoci/new
+  ! lxc file pull testoci/etc/removed testoci/removed
+  ! lxc file pull testoci/etc/opaque/old testoci/old
+
+  # Exported containers can be imported back
+  lxc export testoci testoci/layout
+  [ -f testoci/layout/oci-layout ]
+  grep -q "org.opencontainers.image.ref.name" testoci/layout/index.json
+  lxc export testoci testoci/export.tar
+  lxc image import testoci/export.tar > testoci/out
+  exported=$(awk '{print $NF}' testoci/out)
+  lxc image show "${exported}" | grep "description: testoci"
+  lxc image delete "${exported}"
+
+  lxc delete testoci
+  lxc image delete "${fingerprint}"
+  rm -rf testoci testoci.tar
+}
@@ -0,0 +1,35 @@
+test_profiles() {
+  if ! which curl >/dev/null || ! grep -q "^$(whoami):" /etc/subuid; then
+    echo "==> SKIP: profiles need curl and subuids"
+    return
+  fi
+
+  import_test_image testprofile "test profile image"
+
+  lxd_api PUT /1.0/profiles -d '{"name": "testprofile", "config": [{"key": "lxc.environment", "value": "TESTPROFILE=1"}]}' | grep -q '"result":"success"'
+  lxd_api GET /1.0/profiles/testprofile | grep TESTPROFILE
+
+  # Profiles and config are applied when the container starts, and never
+  # make it into its lxc config file
+  lxd_api POST /1.0/containers -d "{\"name\": \"testprofile1\", \"profiles\": [\"default\", \"testprofile\"], \"config\": [{\"key\": \"lxc.environment\", \"value\": \"TESTCONFIG=1\"}], \"source\": {\"type\": \"image\", \"fingerprint\": \"${fingerprint}\"}}" | lxd_wait
+  lxd_api GET /1.0/containers/testprofile1 | grep '"testprofile"'
+  lxd_api GET /1.0/containers/testprofile1 | grep TESTCONFIG
+  ! grep "TESTPROFILE\|TESTCONFIG" "${LXD_DIR}/lxc/testprofile1/config"
+
+  # Removing them takes them away for good
+  lxd_api PUT /1.0/containers/testprofile1 -d '{"profiles": ["default"], "config": []}' | lxd_wait
+  ! lxd_api GET /1.0/containers/testprofile1 | grep -q '"testprofile"\|TESTCONFIG'
+  ! grep "TESTPROFILE\|TESTCONFIG" "${LXD_DIR}/lxc/testprofile1/config"
+
+  # As does changing the profile itself
+  lxd_api PUT /1.0/containers/testprofile1 -d '{"profiles": ["default", "testprofile"], "config": []}' | lxd_wait
+  lxd_api PUT /1.0/profiles/testprofile -d '{"config": []}' | grep -q '"result":"success"'
+  ! lxd_api GET /1.0/profiles/testprofile | grep -q TESTPROFILE
+  ! grep TESTPROFILE "${LXD_DIR}/lxc/testprofile1/config"
+
+  lxc delete testprofile1
+  lxd_api DELETE /1.0/profiles/testprofile | grep -q '"result":"success"'
+  ! lxd_api GET /1.0/profiles | grep -q testprofile
+  lxc image delete "${fingerprint}"
+  rm -rf testprofile testprofile.tar.gz
+}
@@ -0,0 +1,46 @@
+test_publish() {
+  if ! grep -q "^$(whoami):" /etc/subuid; then
+    echo "==> SKIP: publishing containers needs subuids"
+    return
+  fi
+
+  import_test_image testpub "test publish image"
+
+  lxc create testpub testpub1
+  echo "published" > testpub/marker
+  lxc file push testpub/marker testpub1/etc/marker
+  lxc snapshot testpub1 snap0
+
+  # Published images can be exported, imported back and used
+  lxc publish testpub1 testpub/published > testpub/out
+  published=$(awk '{print $NF}' testpub/out)
+  lxc image show testpub/published | grep "public: false"
+  mkdir -p testpub/export
+  lxc image export "${published}" testpub/export
+  lxc image delete "${published}"
+  ! lxc image list | grep -q "${published}"
+  lxc image import "testpub/export/${published}.tar.gz"
+  lxc image alias create testpub/reimported "${published}"
+  lxc create testpub/reimported testpub2
+  lxc file pull testpub2/etc/marker testpub/pulled
+  grep published testpub/pulled
+
+  # As can snapshots, even while the container changes
+  echo "changed" > testpub/marker
+  lxc file push testpub/marker testpub1/etc/marker
+  lxc publish testpub1/snap0 --public > testpub/out
+  snapshot=$(awk '{print $NF}' testpub/out)
+  lxc image show "${snapshot}" | grep "public: true"
+  lxc image alias create testpub/snapshot "${snapshot}"
+  lxc create testpub/snapshot testpub3
+  lxc file pull testpub3/etc/marker testpub/pulled
+  grep published testpub/pulled
+
+  lxc delete testpub1
+  lxc delete testpub2
+  lxc delete testpub3
+  lxc image delete "${published}"
+  lxc image delete "${snapshot}"
+  lxc image delete "${fingerprint}"
+  rm -rf testpub testpub.tar.gz
+}
@@ -19,5 +19,16 @@ test_remote() {
   # tried to re-add our cert.
   echo y | lxc remote --config ./testconf add local 127.0.0.1:8443 --debug
 
+  # Image servers don't need any authentication.
+  lxc remote --config ./testconf add testimages http+lxc-images://127.0.0.1:8444
+  lxc remote --config ./testconf list | grep 'testimages'
+  lxc remote --config ./testconf remove testimages
+
+  lxc remote --config ./testconf add testrelay http+lxc-images://127.0.0.1:8444 --always-relay
+  lxc remote --config ./testconf list | grep 'testrelay.*always relay'
+  lxc remote --config ./testconf set-url testrelay http+lxc-images://127.0.0.1:8445
+  lxc remote --config ./testconf list | grep 'testrelay.*8445.*always relay'
+  lxc remote --config ./testconf remove testrelay
+
   rm -f testconf || true
 }
@@ -0,0 +1,51 @@
+test_image_signing() {
+  if ! which gpg gpgv python3 >/dev/null || ! grep -q "^$(whoami):" /etc/subuid; then
+    echo "==> SKIP: image signing needs gpg, gpgv, python3 and subuids"
+    return
+  fi
+
+  rm -rf testsigned testconf || true
+  mkdir -p testsigned/gnupg testsigned/meta testsigned/rootfs/etc
+  mkdir -p testsigned/srv/meta/1.0 testsigned/srv/images/testsigned/1 testsigned/srv/images/testsigned/2
+  chmod 700 testsigned/gnupg
+  export GNUPGHOME=$(pwd)/testsigned/gnupg
+
+  gpg --batch --passphrase '' --quick-gen-key "lxd test <lxd@example.com>" default default never
+  gpg --export > "${LXD_DIR}/trusted-keys.gpg"
+
+  # A signed image, and a copy of it whose rootfs gets tampered with
+  # afterwards
+  echo "lxc.arch = x86_64" > testsigned/meta/config
+  echo "testsigned" > testsigned/rootfs/etc/hostname
+  srv=testsigned/srv/images/testsigned/2
+  tar -C testsigned/meta -cJf ${srv}/meta.tar.xz .
+  tar -C testsigned/rootfs -cJf ${srv}/rootfs.tar.xz .
+  gpg --batch --armor --detach-sign ${srv}/meta.tar.xz
+  gpg --batch --armor --detach-sign ${srv}/rootfs.tar.xz
+  cp -a ${srv}/. testsigned/srv/images/testsigned/1/
+  echo "tampered" >> testsigned/srv/images/testsigned/1/rootfs.tar.xz
+  echo "testsigned;1;amd64;default;1;/images/testsigned/1/" > testsigned/srv/meta/1.0/index-user
+  echo "testsigned;2;amd64;default;1;/images/testsigned/2/" >> testsigned/srv/meta/1.0/index-user
+
+  (cd testsigned/srv && exec python3 -m http.server 8444) &
+  server_pid=$!
+  sleep 1
+
+  lxc remote --config ./testconf add testsigned http+lxc-images://127.0.0.1:8444 --insecure
+  ! lxc create --config ./testconf testsigned:testsigned/1/amd64 signed 2> testsigned/err
+  grep "bad signature for rootfs.tar.xz" testsigned/err
+  ! lxc list | grep -q signed
+
+  # Images are verified before being cached
+  [ -z "$(lxc image list)" ]
+
+  lxc create --config ./testconf testsigned:testsigned/2/amd64 signed
+  lxc image show "$(lxc image list)" | grep "verified: true"
+  lxc delete signed
+  lxc image delete "$(lxc image list)"
+
+  kill ${server_pid}
+  unset GNUPGHOME
+  rm -f "${LXD_DIR}/trusted-keys.gpg"
+  rm -rf testsigned testconf
+}
@@ -0,0 +1,126 @@
+test_snapshots() {
+  if ! grep -q "^$(whoami):" /etc/subuid; then
+    echo "==> SKIP: snapshots need subuids"
+    return
+  fi
+
+  import_test_image testsnap "test snapshot image"
+
+  lxc create testsnap testsnap1
+  lxc snapshot testsnap1 snap0
+
+  # Restoring throws away what happened since the snapshot, and keeps it
+  echo "changed" > testsnap/changed
+  lxc file push testsnap/changed testsnap1/etc/changed
+  lxc restore testsnap1 snap0
+  ! lxc file pull testsnap1/etc/changed testsnap/pulled
+  lxc file push testsnap/changed testsnap1/etc/changed
+  lxc restore testsnap1 snap0
+  ! lxc file pull testsnap1/etc/changed testsnap/pulled
+  lxc file pull testsnap1/etc/hostname testsnap/hostname
+  grep testsnap testsnap/hostname
+
+  ! lxc restore testsnap1 nosuchsnap
+  ! lxc restore testsnap1 ../testsnap1 2> testsnap/err
+  grep "bad snapshot name" testsnap/err
+  ! lxc snapshot testsnap1 .. 2> testsnap/err
+  grep "bad snapshot name" testsnap/err
+  ! lxc copy testsnap1/.. testsnap2 2> testsnap/err
+  grep "bad snapshot name" testsnap/err
+  ! ls "${LXD_DIR}/lxc/testsnap1/rootfs.restoring" "${LXD_DIR}/lxc/testsnap1/rootfs.replaced"
+  ! lxc restore testsnap1 snap0 --stateful
+
+  # Snapshot metadata and the rest of the snapshot commands
+  lxc snapshot testsnap1 snap1 --description="second snapshot"
+  lxc snapshot list testsnap1 | grep snap0
+  lxc snapshot list testsnap1 | grep "second snapshot"
+  lxc snapshot info testsnap1/snap1 | grep "stateful: false"
+  grep '"size":' "${LXD_DIR}/lxc/testsnap1/snapshots/snap1/snapshot.json"
+  lxc list | grep "testsnap1/snap1"
+  lxc list testsnap1: | grep "testsnap1/snap0"
+  lxc snapshot rename testsnap1/snap1 snap2
+  lxc snapshot info testsnap1/snap2 | grep "second snapshot"
+  ! lxc snapshot info testsnap1/snap1
+  ! lxc snapshot rename testsnap1/snap2 snap0
+  lxc snapshot delete testsnap1/snap2
+  ! lxc snapshot list testsnap1 | grep -q snap2
+
+  # Protected snapshots only go away by force, expired ones on their own
+  lxc snapshot testsnap1 snap3 --expiry=72h
+  lxc snapshot list testsnap1 | grep "snap3.*expires"
+  lxc snapshot protect testsnap1/snap3
+  lxc snapshot info testsnap1/snap3 | grep "protected: true"
+  ! lxc snapshot delete testsnap1/snap3
+  ! lxc delete testsnap1
+  lxc snapshot unprotect testsnap1/snap3
+  lxc snapshot expire testsnap1/snap3 0
+  ! lxc snapshot list testsnap1 | grep "snap3.*expires"
+  lxc snapshot delete testsnap1/snap3
+  lxc snapshot testsnap1 snap4
+  lxc snapshot protect testsnap1/snap4
+  lxc snapshot delete testsnap1/snap4 --force
+  ! lxc snapshot list testsnap1 | grep -q snap4
+  lxc snapshot protect testsnap1/snap0
+
+  # The daemon deletes expired snapshots, unless they're protected
+  lxc snapshot testsnap1 snap5 --expiry=1s
+  lxc snapshot testsnap1 snap6
+  lxc snapshot protect testsnap1/snap6
+  lxc snapshot expire testsnap1/snap6 1s
+  sleep 3
+  ! lxc snapshot list testsnap1 | grep -q snap5
+  lxc snapshot list testsnap1 | grep snap6
+
+  lxc delete testsnap1 --force
+
+  if which curl >/dev/null; then
+    test_scheduled_snapshots
+  else
+    echo "==> SKIP: scheduled snapshots need curl"
+  fi
+
+  lxc image delete "${fingerprint}"
+  rm -rf testsnap testsnap.tar.gz
+}
+
+# Waits for a scheduled snapshot of the container to show up as an
+# operation, the scheduler running every second in the testsuite
+wait_scheduled_snapshot() {
+  for i in $(seq 500); do
+    for op in $(lxd_api GET /1.0/operations | grep -o '/1.0/operations/[^"]*'); do
+      lxd_api GET "${op}" | grep -q "\"container\":\"$1\",\"snapshot\":\"auto-" && return 0
+    done
+  done
+  return 1
+}
+
+test_scheduled_snapshots() {
+  # Big enough for snapshots to take a moment
+  lxc create testsnap testsnap2
+  dd if=/dev/zero of="${LXD_DIR}/lxc/testsnap2/rootfs/big" bs=1M count=50
+
+  # Scheduled snapshots are operations like any other, and are pruned down
+  # to the retention count
+  lxd_api PUT /1.0/containers/testsnap2 -d '{"profiles": ["default"], "config": [{"key": "snapshots.schedule", "value": "1s"}, {"key": "snapshots.retention", "value": "2"}]}' | lxd_wait
+  wait_scheduled_snapshot testsnap2
+  sleep 4
+  lxd_api PUT /1.0/containers/testsnap2 -d '{"profiles": ["default"], "config": []}' | lxd_wait
+  sleep 2
+  [ "$(lxc snapshot list testsnap2 | grep -c '^auto-')" -eq 2 ]
+  lxc snapshot list testsnap2 | grep "scheduled snapshot"
+
+  # The same, from a profile, which leaves protected ones alone
+  protected=$(lxc snapshot list testsnap2 | grep '^auto-' | head -n1 | cut -f1)
+  lxc snapshot protect "testsnap2/${protected}"
+  lxd_api PUT /1.0/profiles -d '{"name": "testsnapshots", "config": [{"key": "snapshots.schedule", "value": "1s"}, {"key": "snapshots.retention", "value": "1"}]}' | grep -q '"result":"success"'
+  lxd_api PUT /1.0/containers/testsnap2 -d '{"profiles": ["default", "testsnapshots"], "config": []}' | lxd_wait
+  wait_scheduled_snapshot testsnap2
+  sleep 2
+  lxd_api PUT /1.0/containers/testsnap2 -d '{"profiles": ["default"], "config": []}' | lxd_wait
+  sleep 2
+  [ "$(lxc snapshot list testsnap2 | grep -c '^auto-')" -eq 2 ]
+  lxc snapshot list testsnap2 | grep "^${protected}"
+
+  lxd_api DELETE /1.0/profiles/testsnapshots | grep -q '"result":"success"'
+  lxc delete testsnap2 --force
+}